@@ -1,28 +1,115 @@
 package main
 
 import (
-	"compress/gzip"
+	"bytes"
 	"fmt"
 	"io/ioutil"
 	"log"
 	"os"
-	"os/user"
+	"path/filepath"
 	"strconv"
+	"strings"
 	"sync"
 
 	libvirt "github.com/libvirt/libvirt-go"
 	"github.com/urfave/cli"
 )
 
+type nodeOptions struct {
+	flavor       string
+	memory       int
+	cpus         int
+	diskSize     uint64
+	networks     []string
+	image        imageRef
+	group        string
+	cluster      string
+	userData     []string
+	passwordAuth bool
+	sshKeys      []string
+	addresses    []string
+	gateways     []string
+	dns          []string
+	// ignition is set for images that are provisioned with Ignition
+	ignition bool
+}
+
+func defaultNodeOptions() nodeOptions {
+	return nodeOptions{
+		flavor: DEFAULT_FLAVOR,
+		memory: 4096,
+		cpus:   4,
+		image:  imageRef{source: DEFAULT_IMAGE_SOURCE},
+	}
+}
+
 func addNode(c *cli.Context) error {
-	conn, err := libvirt.NewConnect("qemu:///session")
+	conn, err := connect(c)
 
 	if err != nil {
 		log.Fatal(err)
 	}
 	defer conn.Close()
+
+	workerCount, err := nextNodeNumber(conn)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	dir := getProjectDir(c)
+	conf, err := readConfig(dir)
+	if err != nil {
+		return err
+	}
+
+	opts := defaultNodeOptions()
+	opts.image, err = parseImageRef(c.String("image"))
+	if err != nil {
+		return err
+	}
+	if version := c.String("image-version"); version != "" {
+		if opts.image.version != "" && opts.image.version != version {
+			return fmt.Errorf("--image %s and --image-version %s contradict each other", opts.image, version)
+		}
+		opts.image.version = version
+	}
+	opts.image = opts.image.withDefaultVersion(conf)
+	err = opts.applyFlavorFlags(c, conf)
+	if err != nil {
+		return err
+	}
+	opts.userData = c.StringSlice("user-data")
+	opts.passwordAuth = c.Bool("password-auth")
+	opts.sshKeys = c.StringSlice("ssh-key")
+	opts.networks = c.StringSlice("network")
+	opts.addresses = c.StringSlice("ip")
+	opts.gateways = c.StringSlice("gateway")
+	opts.dns = c.StringSlice("dns")
+
+	storage, err := newNodeStorage(c, conn, dir)
+	if err != nil {
+		return err
+	}
+	defer storage.close()
+
+	err = createNode(conn, storage, dir, workerCount, opts)
+	if err != nil || !c.Bool("wait") {
+		return err
+	}
+
+	name := fmt.Sprintf("atomic-host%d", workerCount)
+	dom, err := conn.LookupDomainByName(name)
+	if err != nil {
+		return err
+	}
+	defer dom.Free()
+	fmt.Printf("waiting for %s\n", name)
+	return waitForNode(conn, dom, dir, "", c.Duration("timeout"))
+}
+
+func nextNodeNumber(conn *libvirt.Connect) (int, error) {
 	workerCount := 1
-	err = forEachNode(conn, func(dom *libvirt.Domain, name, nodeNumber string) error {
+	err := forEachNode(conn, func(dom *libvirt.Domain, name, nodeNumber string) error {
 		number, err := strconv.Atoi(nodeNumber)
 		if err != nil {
 			return err
@@ -32,81 +119,230 @@ func addNode(c *cli.Context) error {
 		}
 		return nil
 	})
+	return workerCount, err
+}
 
+func createNode(conn *libvirt.Connect, storage nodeStorage, dir string, workerCount int, opts nodeOptions) error {
+	src, err := lookupImageSource(dir, opts.image.source)
 	if err != nil {
-		log.Fatal(err)
+		return err
+	}
+	entries, err := readIndex(dir, src)
+	if err != nil {
+		return err
+	}
+	entry, err := selectIndexEntry(entries, opts.image.version)
+	if err != nil {
+		return err
+	}
+	if !entry.isPresent {
+		return fmt.Errorf("%s has not been downloaded yet. Run node-manager image pull %s first", entry, entry.ref())
+	}
+	opts.ignition = src.usesIgnition()
+	if opts.ignition && len(opts.userData) > 0 {
+		return fmt.Errorf("%s is provisioned with Ignition, which does not understand user-data", src.name())
+	}
+
+	opts.networks, err = resolveNetworks(conn, opts.networks)
+	if err != nil {
+		return err
+	}
+	conf, err := readConfig(dir)
+	if err != nil {
+		return err
+	}
+	var interfaces []interfaceConfig
+	opts.networks, interfaces, err = configureAddresses(conn, conf, opts.networks, opts)
+	if err != nil {
+		return err
+	}
+	if opts.ignition && len(interfaces) > 0 {
+		return fmt.Errorf("%s is provisioned with Ignition, which does not support static addresses. Use DHCP instead", src.name())
+	}
+	networkConfig := ""
+	if len(interfaces) > 0 {
+		networkConfig, err = renderNetworkConfig(interfaces)
+		if err != nil {
+			return err
+		}
+	}
+
+	name := "atomic-host" + strconv.Itoa(workerCount)
+	hostname := fmt.Sprintf("atomic%d", workerCount)
+	nodeDir := fmt.Sprintf("%s/images/%s", dir, name)
+
+	sshKeys, err := collectSSHKeys(dir, opts.sshKeys)
+	if err != nil {
+		return err
+	}
+	password, err := generatePassword()
+	if err != nil {
+		return err
+	}
+	var userData string
+	var ignitionConfig []byte
+	if opts.ignition {
+		ignitionConfig, err = renderIgnition(src.defaultUser(), hostname, sshKeys, password, opts.passwordAuth)
+	} else {
+		ctx := userDataContext{
+			Number:   workerCount,
+			Name:     name,
+			Hostname: hostname,
+			Cluster:  opts.cluster,
+			Group:    opts.group,
+			SSHKeys:  sshKeys,
+		}
+		userData, err = renderUserData(opts.userData, defaultCloudConfig(sshKeys, password, opts.passwordAuth), ctx)
+	}
+	if err != nil {
+		return err
+	}
+
+	var dhcpHost *networkDHCPHost
+	opts.networks, dhcpHost, err = reserveClusterAddress(conn, opts.networks, hostname)
+	if err != nil {
+		return err
+	}
+	releaseAddress := func() {
+		if dhcpHost == nil {
+			return
+		}
+		err := releaseClusterAddress(conn, dhcpHost)
+		if err != nil {
+			log.Printf("could not remove the dhcp entry of %s: %s\n", hostname, err)
+		}
 	}
 
 	errors := make(chan error, 2)
 	var wg sync.WaitGroup
 	wg.Add(2)
 
-	dir := getProjectDir(c)
-
-	nodeDir := fmt.Sprintf("%s/images/atomic-host%d", dir, workerCount)
-
 	err = os.MkdirAll(nodeDir, os.ModePerm)
 	if err != nil {
 		log.Println("could not create node directory " + nodeDir)
-		log.Fatal(err)
+		releaseAddress()
+		return err
 	}
 
-	destPath := fmt.Sprintf("%s/image.qcow2", nodeDir)
+	err = writeFile(fmt.Sprintf("%s/base-image", nodeDir), entry.ref())
+	if err == nil {
+		err = ioutil.WriteFile(passwordFile(nodeDir), []byte(password), 0600)
+	}
+	if err != nil {
+		os.RemoveAll(nodeDir)
+		releaseAddress()
+		return err
+	}
 
-	go unpackDisk(dir, destPath, &wg, errors)
-	go prepareIso(nodeDir, workerCount, &wg, errors)
+	var diskPath, seedPath string
+	go prepareDisk(storage, name, entry, opts.diskSize, &diskPath, &wg, errors)
+	if opts.ignition {
+		go prepareIgnition(storage, nodeDir, name, ignitionConfig, &seedPath, &wg, errors)
+	} else {
+		go prepareIso(storage, nodeDir, name, workerCount, userData, networkConfig, &seedPath, &wg, errors)
+	}
 
 	wg.Wait()
 	close(errors)
-	for err := range errors {
+	for err = range errors {
 		if err != nil {
-			return err
+			break
 		}
 	}
 
-	err = run("virt-install",
-		"--name", "atomic-host"+strconv.Itoa(workerCount),
-		"--ram", "4096",
-		"--vcpus", "4",
-		"--disk", fmt.Sprintf("path=%s", destPath),
-		"--os-type", "linux",
-		"--os-variant", "rhel-atomic-7.2",
-		"--network", "bridge=bridge0",
-		"--network", "default",
-		"--virt-type", "kvm",
-		"--graphics", fmt.Sprintf("vnc,listen=127.0.0.1,port=590%d", workerCount),
-		"--cdrom", fmt.Sprintf("%s/init.iso", nodeDir),
-		"--noautoconsole",
-	)
+	if err == nil {
+		meta := &nodeMetadata{
+			Group:     opts.group,
+			Flavor:    opts.flavor,
+			Image:     entry.ref(),
+			User:      src.defaultUser(),
+			Ignition:  opts.ignition,
+			Addresses: staticAddresses(interfaces),
+		}
+		var consoleLog string
+		consoleLog, err = consoleLogPath(conn, nodeDir)
+		if err == nil && consoleLog != "" {
+			// created upfront, so that the log stays readable by the user
+			// when libvirt runs as root
+			err = ioutil.WriteFile(consoleLog, nil, 0644)
+		}
+		if err == nil {
+			err = defineAndStartNode(conn, name, opts, meta, diskPath, seedPath, consoleLog)
+		}
+	}
 	if err != nil {
 		//cleanup
-		cleanupErr := os.RemoveAll(nodeDir)
+		cleanupErr := deleteVolumes(conn, []string{diskPath, seedPath})
+		if cleanupErr == nil {
+			cleanupErr = os.RemoveAll(nodeDir)
+		}
 		if cleanupErr != nil {
 			log.Println("could not clean up:", cleanupErr)
 		}
+		releaseAddress()
+	} else if dhcpHost != nil {
+		fmt.Printf("%s gets the address %s\n", hostname, dhcpHost.IP)
+	}
+	if err == nil && len(staticAddresses(interfaces)) > 0 {
+		fmt.Printf("%s gets the static addresses %s\n", hostname, strings.Join(staticAddresses(interfaces), ", "))
 	}
 	return err
 }
 
-func prepareIso(nodeDir string, workerCount int, wg *sync.WaitGroup, errorChannel chan<- error) {
-	defer wg.Done()
-	usr, err := user.Current()
+func defineAndStartNode(conn *libvirt.Connect, name string, opts nodeOptions, meta *nodeMetadata, diskPath, seedPath, consoleLog string) error {
+	def, err := newDomainDef(name, opts, diskPath, seedPath, consoleLog)
 	if err != nil {
-		errorChannel <- err
-		return
+		return err
+	}
+	xmlConfig, err := def.Marshal()
+	if err != nil {
+		return err
+	}
+	dom, err := conn.DomainDefineXML(xmlConfig)
+	if err != nil {
+		return err
 	}
-	sshPublicKeyFile := fmt.Sprintf("%s/.ssh/id_rsa.pub", usr.HomeDir)
-	sshPublicKey, err := ioutil.ReadFile(sshPublicKeyFile)
+	defer dom.Free()
 
+	err = setNodeMetadata(dom, meta)
+	if err == nil {
+		err = dom.Create()
+	}
+	if err != nil {
+		undefineErr := dom.Undefine()
+		if undefineErr != nil {
+			log.Printf("could not undefine %s: %s\n", name, undefineErr)
+		}
+		return err
+	}
+	if address, err := vncAddress(dom); err == nil {
+		fmt.Printf("%s is displayed at vnc://%s\n", name, address)
+	}
+	return nil
+}
+
+// defaultCloudConfig is the cloud-config every node gets. User-data
+// templates are merged into it. The password is meant for the console,
+// ssh only accepts it with passwordAuth.
+func defaultCloudConfig(sshKeys []string, password string, passwordAuth bool) map[interface{}]interface{} {
+	keys := make([]interface{}, 0, len(sshKeys))
+	for _, key := range sshKeys {
+		keys = append(keys, key)
+	}
+	return map[interface{}]interface{}{
+		"password":            password,
+		"ssh_pwauth":          passwordAuth,
+		"chpasswd":            map[interface{}]interface{}{"expire": false},
+		"ssh_authorized_keys": keys,
+	}
+}
+
+// prepareIso writes the NoCloud seed of a node. An empty networkConfig
+// leaves the network to DHCP.
+func prepareIso(storage nodeStorage, nodeDir, name string, workerCount int, userData, networkConfig string, isoPath *string, wg *sync.WaitGroup, errorChannel chan<- error) {
+	defer wg.Done()
 	userDataFile := fmt.Sprintf("%s/user-data", nodeDir)
-	err = writeFile(userDataFile,
-		"#cloud-config",
-		"password: atomic",
-		"ssh_pwauth: True",
-		"chpasswd: { expire: False }",
-		"ssh_authorized_keys:",
-		fmt.Sprintf("  - %s", sshPublicKey),
-	)
+	err := ioutil.WriteFile(userDataFile, []byte(userData), 0600)
 	if err != nil {
 		errorChannel <- err
 		return
@@ -124,42 +360,63 @@ func prepareIso(nodeDir string, workerCount int, wg *sync.WaitGroup, errorChanne
 		return
 	}
 
-	isoPath := fmt.Sprintf("%s/init.iso", nodeDir)
-	err = run("genisoimage",
-		"-output", isoPath,
-		"-volid", "cidata", "-joliet", "-rock",
-		userDataFile, metaDataFile,
-	)
+	files := []string{userDataFile, metaDataFile}
+	if networkConfig != "" {
+		networkConfigFile := fmt.Sprintf("%s/network-config", nodeDir)
+		err = ioutil.WriteFile(networkConfigFile, []byte(networkConfig), 0644)
+		if err != nil {
+			errorChannel <- err
+			return
+		}
+		files = append(files, networkConfigFile)
+	}
+
+	iso, err := seedISO(files...)
 	if err != nil {
 		errorChannel <- err
 		return
 	}
+	*isoPath, err = storage.createSeed(name, iso)
+	errorChannel <- err
 }
 
-func unpackDisk(workDir, destPath string, wg *sync.WaitGroup, errorChannel chan<- error) {
+// prepareIgnition writes the Ignition config of a node, which replaces the
+// NoCloud seed for Ignition images.
+func prepareIgnition(storage nodeStorage, nodeDir, name string, config []byte, configPath *string, wg *sync.WaitGroup, errorChannel chan<- error) {
 	defer wg.Done()
-
-	entries, err := readIndex(workDir)
-
+	err := ioutil.WriteFile(fmt.Sprintf("%s/config.ign", nodeDir), config, 0600)
 	if err != nil {
 		errorChannel <- err
 		return
 	}
-	latest := entries[len(entries)-1]
-	basePath := fmt.Sprintf("%s/base/images/%s", workDir, latest.fileName)
-
-	f, err := os.Open(basePath)
+	*configPath, err = storage.createIgnition(name, config)
+	errorChannel <- err
+}
 
-	if err != nil {
-		errorChannel <- err
-		return
-	}
-	defer f.Close()
-	gzipReader, err := gzip.NewReader(f)
-	if err != nil {
-		errorChannel <- err
-		return
+// seedISO packs files into a NoCloud seed image, which cloud-init finds by
+// its volume label cidata.
+func seedISO(files ...string) ([]byte, error) {
+	iso := newISOImage("cidata")
+	for _, file := range files {
+		content, err := ioutil.ReadFile(file)
+		if err != nil {
+			return nil, err
+		}
+		info, err := os.Stat(file)
+		if err != nil {
+			return nil, err
+		}
+		iso.addFile(filepath.Base(file), content, info.Mode())
 	}
 
-	errorChannel <- writeToFile(gzipReader, destPath)
+	buf := &bytes.Buffer{}
+	_, err := iso.WriteTo(buf)
+	return buf.Bytes(), err
+}
+
+func prepareDisk(storage nodeStorage, name string, entry *IndexEntry, diskSize uint64, diskPath *string, wg *sync.WaitGroup, errorChannel chan<- error) {
+	defer wg.Done()
+	var err error
+	*diskPath, err = storage.createDisk(name, entry, diskSize)
+	errorChannel <- err
 }
@@ -0,0 +1,330 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"log"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+
+	libvirt "github.com/libvirt/libvirt-go"
+	"github.com/urfave/cli"
+)
+
+type existingNode struct {
+	name     string
+	number   int
+	group    string
+	memory   int
+	cpus     int
+	image    string
+	diskSize uint64
+	networks []string
+}
+
+type planAction struct {
+	kind  string
+	group string
+	node  *existingNode
+	opts  nodeOptions
+	drift []string
+}
+
+func applyCommand(c *cli.Context) error {
+	location := c.Args().First()
+	if location == "" {
+		return fmt.Errorf("no cluster file given")
+	}
+	spec, err := readClusterSpec(location)
+	if err != nil {
+		return err
+	}
+
+	conn, err := connect(c)
+	if err != nil {
+		log.Fatal(err)
+	}
+	defer conn.Close()
+
+	nodes, err := listExistingNodes(conn)
+	if err != nil {
+		return err
+	}
+
+	workDir := getProjectDir(c)
+	conf, err := readConfig(workDir)
+	if err != nil {
+		return err
+	}
+
+	plan, unmanaged, err := planCluster(spec, conf, nodes)
+	if err != nil {
+		return err
+	}
+	for _, node := range unmanaged {
+		fmt.Printf("ignoring %s, it does not belong to any group\n", node.name)
+	}
+	if len(plan) == 0 {
+		fmt.Println("cluster is up to date")
+		return nil
+	}
+	printPlan(plan)
+
+	changes := 0
+	for _, action := range plan {
+		if action.kind != "drift" {
+			changes++
+		}
+	}
+	if c.Bool("dry-run") || changes == 0 {
+		return nil
+	}
+	if !c.Bool("yes") && !confirm("apply these changes?") {
+		fmt.Println("aborted")
+		return nil
+	}
+
+	storage, err := newNodeStorage(c, conn, workDir)
+	if err != nil {
+		return err
+	}
+	defer storage.close()
+
+	for _, action := range plan {
+		err = applyAction(conn, storage, workDir, action)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func listExistingNodes(conn *libvirt.Connect) ([]*existingNode, error) {
+	nodes := make([]*existingNode, 0)
+	err := forEachNode(conn, func(dom *libvirt.Domain, name, nodeNumber string) error {
+		number, err := strconv.Atoi(nodeNumber)
+		if err != nil {
+			return err
+		}
+		meta, err := getNodeMetadata(dom)
+		if err != nil {
+			return err
+		}
+		info, err := dom.GetInfo()
+		if err != nil {
+			return err
+		}
+		def, err := readDomainDef(dom)
+		if err != nil {
+			return err
+		}
+		node := &existingNode{
+			name:     name,
+			number:   number,
+			group:    meta.Group,
+			memory:   int(info.MaxMem / 1024),
+			cpus:     int(info.NrVirtCpu),
+			image:    meta.Image,
+			networks: make([]string, 0),
+		}
+		if blockInfo, err := dom.GetBlockInfo("vda", 0); err == nil {
+			node.diskSize = blockInfo.Capacity
+		}
+		for _, iface := range def.Devices.Interfaces {
+			node.networks = append(node.networks, iface.notation())
+		}
+		nodes = append(nodes, node)
+		return nil
+	})
+	sort.Slice(nodes, func(i, j int) bool {
+		return nodes[i].number < nodes[j].number
+	})
+	return nodes, err
+}
+
+func planCluster(spec *clusterSpec, conf *config, nodes []*existingNode) ([]planAction, []*existingNode, error) {
+	byGroup := make(map[string][]*existingNode)
+	unmanaged := make([]*existingNode, 0)
+	for _, node := range nodes {
+		if node.group == "" {
+			unmanaged = append(unmanaged, node)
+			continue
+		}
+		byGroup[node.group] = append(byGroup[node.group], node)
+	}
+
+	plan := make([]planAction, 0)
+	for _, group := range spec.Groups {
+		opts, err := group.nodeOptions(conf, spec.Name)
+		if err != nil {
+			return nil, nil, err
+		}
+		members := byGroup[group.Name]
+		delete(byGroup, group.Name)
+
+		for i, node := range members {
+			if i >= group.Count {
+				plan = append(plan, planAction{kind: "remove", group: group.Name, node: node})
+				continue
+			}
+			if node.memory != opts.memory || node.cpus != opts.cpus {
+				plan = append(plan, planAction{kind: "resize", group: group.Name, node: node, opts: opts})
+			}
+			if drift := node.drift(opts); len(drift) > 0 {
+				plan = append(plan, planAction{kind: "drift", group: group.Name, node: node, opts: opts, drift: drift})
+			}
+		}
+		for i := len(members); i < group.Count; i++ {
+			plan = append(plan, planAction{kind: "create", group: group.Name, opts: opts})
+		}
+	}
+
+	groups := make([]string, 0, len(byGroup))
+	for name := range byGroup {
+		groups = append(groups, name)
+	}
+	sort.Strings(groups)
+	for _, name := range groups {
+		for _, node := range byGroup[name] {
+			plan = append(plan, planAction{kind: "remove", group: name, node: node})
+		}
+	}
+	return plan, unmanaged, nil
+}
+
+// drift describes the differences between node and opts that resizing can
+// not fix. The image only counts if opts asks for a version.
+func (n *existingNode) drift(opts nodeOptions) []string {
+	drift := make([]string, 0)
+	image := opts.image.String()
+	if opts.image.version == "" {
+		image = opts.image.source
+		if n.image != "" && strings.SplitN(n.image, ":", 2)[0] != image {
+			drift = append(drift, fmt.Sprintf("image %s instead of %s", n.image, image))
+		}
+	} else if n.image != image {
+		drift = append(drift, fmt.Sprintf("image %s instead of %s", n.image, image))
+	}
+	if n.diskSize > 0 && n.diskSize < opts.diskSize {
+		drift = append(drift, fmt.Sprintf("disk of %s instead of %s", formatBytes(n.diskSize), formatBytes(opts.diskSize)))
+	}
+	// without networks, nodes get the default networks of the host
+	if len(opts.networks) > 0 {
+		wanted := make([]string, 0)
+		for _, network := range opts.networks {
+			iface, err := parseNetwork(network)
+			if err == nil && iface != nil {
+				wanted = append(wanted, iface.notation())
+			}
+		}
+		actual := append([]string{}, n.networks...)
+		sort.Strings(wanted)
+		sort.Strings(actual)
+		if strings.Join(wanted, " ") != strings.Join(actual, " ") {
+			drift = append(drift, fmt.Sprintf("networks %s instead of %s", strings.Join(actual, ", "), strings.Join(wanted, ", ")))
+		}
+	}
+	return drift
+}
+
+func printPlan(plan []planAction) {
+	fmt.Println("planned changes:")
+	for _, action := range plan {
+		switch action.kind {
+		case "create":
+			networks := strings.Join(action.opts.networks, ", ")
+			if networks == "" {
+				networks = "default"
+			}
+			fmt.Printf("  + create new node in group %s (flavor %s, %d MiB, %d vCPUs, networks: %s)\n",
+				action.group, action.opts.flavor, action.opts.memory, action.opts.cpus, networks)
+		case "resize":
+			fmt.Printf("  ~ resize %s in group %s (%d MiB -> %d MiB, %d -> %d vCPUs)\n",
+				action.node.name, action.group, action.node.memory, action.opts.memory, action.node.cpus, action.opts.cpus)
+		case "remove":
+			fmt.Printf("  - remove %s from group %s\n", action.node.name, action.group)
+		case "drift":
+			fmt.Printf("  ! %s in group %s differs from the cluster file: %s. Remove it to have it recreated.\n",
+				action.node.name, action.group, strings.Join(action.drift, ", "))
+		}
+	}
+}
+
+func applyAction(conn *libvirt.Connect, storage nodeStorage, workDir string, action planAction) error {
+	switch action.kind {
+	case "create":
+		number, err := nextNodeNumber(conn)
+		if err != nil {
+			return err
+		}
+		fmt.Printf("creating atomic-host%d\n", number)
+		return createNode(conn, storage, workDir, number, action.opts)
+	case "resize":
+		dom, err := conn.LookupDomainByName(action.node.name)
+		if err != nil {
+			return err
+		}
+		defer dom.Free()
+		fmt.Printf("resizing %s\n", action.node.name)
+		return resizeNode(dom, action.node, action.opts)
+	case "remove":
+		dom, err := conn.LookupDomainByName(action.node.name)
+		if err != nil {
+			return err
+		}
+		defer dom.Free()
+		return removeNode(conn, dom, action.node.name, workDir)
+	case "drift":
+		// reported in the plan only, recreating a node loses its data
+		return nil
+	}
+	return fmt.Errorf("unknown action %s", action.kind)
+}
+
+// resizeNode changes the persistent configuration only. A running node picks
+// up the new size on its next boot.
+func resizeNode(dom *libvirt.Domain, node *existingNode, opts nodeOptions) error {
+	memory := uint64(opts.memory) * 1024
+	memoryFlags := []libvirt.DomainMemoryModFlags{libvirt.DOMAIN_MEM_CONFIG | libvirt.DOMAIN_MEM_MAXIMUM, libvirt.DOMAIN_MEM_CONFIG}
+	if opts.memory < node.memory {
+		memoryFlags[0], memoryFlags[1] = memoryFlags[1], memoryFlags[0]
+	}
+	for _, flags := range memoryFlags {
+		err := dom.SetMemoryFlags(memory, flags)
+		if err != nil {
+			return err
+		}
+	}
+
+	vcpuFlags := []libvirt.DomainVcpuFlags{libvirt.DOMAIN_VCPU_CONFIG | libvirt.DOMAIN_VCPU_MAXIMUM, libvirt.DOMAIN_VCPU_CONFIG}
+	if opts.cpus < node.cpus {
+		vcpuFlags[0], vcpuFlags[1] = vcpuFlags[1], vcpuFlags[0]
+	}
+	for _, flags := range vcpuFlags {
+		err := dom.SetVcpusFlags(uint(opts.cpus), flags)
+		if err != nil {
+			return err
+		}
+	}
+
+	active, err := dom.IsActive()
+	if err != nil {
+		return err
+	}
+	if active {
+		fmt.Printf("%s is running. The new size applies after its next restart.\n", node.name)
+	}
+	return nil
+}
+
+func confirm(question string) bool {
+	fmt.Printf("%s [y/N] ", question)
+	answer, err := bufio.NewReader(os.Stdin).ReadString('\n')
+	if err != nil {
+		return false
+	}
+	answer = strings.ToLower(strings.TrimSpace(answer))
+	return answer == "y" || answer == "yes"
+}
@@ -0,0 +1,446 @@
+package main
+
+import (
+	"crypto/rand"
+	"encoding/binary"
+	"encoding/xml"
+	"fmt"
+	"net"
+	"strings"
+
+	libvirt "github.com/libvirt/libvirt-go"
+	"github.com/urfave/cli"
+)
+
+// CLUSTER_NETWORK is the libvirt network that node-manager defines for its
+// nodes. Every node in it gets a static DHCP entry with its hostname.
+const CLUSTER_NETWORK = "node-manager"
+const DEFAULT_CLUSTER_SUBNET = "192.168.150.0/24"
+
+type networkDef struct {
+	XMLName xml.Name        `xml:"network"`
+	Name    string          `xml:"name"`
+	Forward *networkForward `xml:"forward"`
+	Domain  *networkDomain  `xml:"domain"`
+	IPs     []networkIP     `xml:"ip"`
+}
+
+type networkForward struct {
+	Mode string `xml:"mode,attr"`
+}
+
+type networkDomain struct {
+	Name      string `xml:"name,attr"`
+	LocalOnly string `xml:"localOnly,attr,omitempty"`
+}
+
+type networkIP struct {
+	Address string       `xml:"address,attr"`
+	Prefix  int          `xml:"prefix,attr,omitempty"`
+	Netmask string       `xml:"netmask,attr,omitempty"`
+	DHCP    *networkDHCP `xml:"dhcp"`
+}
+
+type networkDHCP struct {
+	Ranges []networkDHCPRange `xml:"range"`
+	Hosts  []networkDHCPHost  `xml:"host"`
+}
+
+type networkDHCPRange struct {
+	Start string `xml:"start,attr"`
+	End   string `xml:"end,attr"`
+}
+
+type networkDHCPHost struct {
+	XMLName xml.Name `xml:"host"`
+	MAC     string   `xml:"mac,attr"`
+	Name    string   `xml:"name,attr,omitempty"`
+	IP      string   `xml:"ip,attr"`
+}
+
+func createNetworkCommand(c *cli.Context) error {
+	conf, err := readConfig(getProjectDir(c))
+	if err != nil {
+		return err
+	}
+	settings := conf.ClusterNetwork
+	for flag, value := range map[string]*string{
+		"subnet":     &settings.Subnet,
+		"dhcp-start": &settings.DHCPStart,
+		"dhcp-end":   &settings.DHCPEnd,
+		"domain":     &settings.Domain,
+	} {
+		if c.String(flag) != "" {
+			*value = c.String(flag)
+		}
+	}
+	settings.Isolated = settings.Isolated || c.Bool("isolated")
+	def, err := newClusterNetworkDef(settings)
+	if err != nil {
+		return err
+	}
+	networkXML, err := xml.Marshal(def)
+	if err != nil {
+		return err
+	}
+
+	conn, err := connect(c)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+
+	if existing, err := conn.LookupNetworkByName(CLUSTER_NETWORK); err == nil {
+		existing.Free()
+		return fmt.Errorf("network %s already exists. Remove it first with node-manager network rm", CLUSTER_NETWORK)
+	}
+	network, err := conn.NetworkDefineXML(string(networkXML))
+	if err != nil {
+		return err
+	}
+	defer network.Free()
+	err = network.Create()
+	if err == nil {
+		err = network.SetAutostart(true)
+	}
+	if err != nil {
+		network.Destroy()
+		network.Undefine()
+		return err
+	}
+	fmt.Printf("created network %s with address %s/%d. Nodes added from now on are attached to it.\n", CLUSTER_NETWORK, def.IPs[0].Address, def.IPs[0].Prefix)
+	return nil
+}
+
+func removeNetworkCommand(c *cli.Context) error {
+	conn, err := connect(c)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+
+	users := make([]string, 0)
+	err = forEachNode(conn, func(dom *libvirt.Domain, name, nodeNumber string) error {
+		def, err := readDomainDef(dom)
+		if err != nil {
+			return err
+		}
+		for _, iface := range def.Devices.Interfaces {
+			if iface.Type == "network" && iface.Source.Network == CLUSTER_NETWORK {
+				users = append(users, name)
+				break
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	if len(users) > 0 {
+		return fmt.Errorf("can not remove network %s, it is used by %s", CLUSTER_NETWORK, strings.Join(users, ", "))
+	}
+
+	network, err := conn.LookupNetworkByName(CLUSTER_NETWORK)
+	if err != nil {
+		return fmt.Errorf("network %s not found", CLUSTER_NETWORK)
+	}
+	defer network.Free()
+	active, err := network.IsActive()
+	if err == nil && active {
+		err = network.Destroy()
+	}
+	if err == nil {
+		err = network.Undefine()
+	}
+	if err != nil {
+		return err
+	}
+	fmt.Printf("removed network %s\n", CLUSTER_NETWORK)
+	return nil
+}
+
+// newClusterNetworkDef describes a NATed, or with isolated a host-only,
+// network. The host takes the first address of the subnet. The DHCP range
+// defaults to the rest of it.
+func newClusterNetworkDef(settings clusterNetworkConfig) (*networkDef, error) {
+	if settings.Subnet == "" {
+		settings.Subnet = DEFAULT_CLUSTER_SUBNET
+	}
+	_, subnet, err := net.ParseCIDR(settings.Subnet)
+	if err != nil {
+		return nil, fmt.Errorf("invalid subnet %s: %s", settings.Subnet, err)
+	}
+	if subnet.IP.To4() == nil {
+		return nil, fmt.Errorf("invalid subnet %s. Only IPv4 is supported", settings.Subnet)
+	}
+	prefix, bits := subnet.Mask.Size()
+	if bits-prefix < 3 {
+		return nil, fmt.Errorf("subnet %s is too small", settings.Subnet)
+	}
+	first := ipToInt(subnet.IP)
+	last := first | (1<<uint(bits-prefix) - 1)
+	gateway := intToIP(first + 1)
+
+	start := intToIP(first + 2)
+	end := intToIP(last - 1)
+	for _, bound := range []struct {
+		value string
+		ip    *net.IP
+	}{{settings.DHCPStart, &start}, {settings.DHCPEnd, &end}} {
+		if bound.value == "" {
+			continue
+		}
+		ip := net.ParseIP(bound.value).To4()
+		if ip == nil || !subnet.Contains(ip) || ip.Equal(gateway) || ipToInt(ip) == first || ipToInt(ip) == last {
+			return nil, fmt.Errorf("invalid dhcp address %s. It needs to be a host address in %s other than %s", bound.value, subnet, gateway)
+		}
+		*bound.ip = ip
+	}
+	if ipToInt(start) > ipToInt(end) {
+		return nil, fmt.Errorf("dhcp range %s - %s is empty", start, end)
+	}
+
+	def := &networkDef{
+		Name: CLUSTER_NETWORK,
+		IPs: []networkIP{{
+			Address: gateway.String(),
+			Prefix:  prefix,
+			DHCP:    &networkDHCP{Ranges: []networkDHCPRange{{Start: start.String(), End: end.String()}}},
+		}},
+	}
+	if !settings.Isolated {
+		def.Forward = &networkForward{Mode: "nat"}
+	}
+	if settings.Domain != "" {
+		def.Domain = &networkDomain{Name: settings.Domain, LocalOnly: "yes"}
+	}
+	return def, nil
+}
+
+// reserveClusterAddress gives the interface of a node in the cluster
+// network a fixed mac address and adds a DHCP entry for it, which maps the
+// mac to the next free address and to hostname. It returns the networks
+// with the mac and the entry, which is nil if the node is not in the
+// cluster network.
+func reserveClusterAddress(conn *libvirt.Connect, networks []string, hostname string) ([]string, *networkDHCPHost, error) {
+	index := -1
+	for i, network := range networks {
+		iface, err := parseNetwork(network)
+		if err != nil {
+			return nil, nil, err
+		}
+		if iface == nil || iface.Type != "network" || iface.Source.Network != CLUSTER_NETWORK {
+			continue
+		}
+		if index >= 0 {
+			return nil, nil, fmt.Errorf("network %s can only be attached once", CLUSTER_NETWORK)
+		}
+		index = i
+	}
+	if index < 0 {
+		return networks, nil, nil
+	}
+
+	network, err := conn.LookupNetworkByName(CLUSTER_NETWORK)
+	if err != nil {
+		return nil, nil, err
+	}
+	defer network.Free()
+	def, err := readNetworkDef(network)
+	if err != nil {
+		return nil, nil, err
+	}
+	ip := def.dhcpIP()
+	if ip == nil {
+		return nil, nil, fmt.Errorf("network %s has no dhcp range", CLUSTER_NETWORK)
+	}
+
+	iface, _ := parseNetwork(networks[index])
+	host := &networkDHCPHost{Name: hostname}
+	if iface.MAC != nil {
+		host.MAC = iface.MAC.Address
+	} else {
+		host.MAC, err = randomMAC()
+		if err != nil {
+			return nil, nil, err
+		}
+	}
+
+	leases := make([]string, 0)
+	if dhcpLeases, err := network.GetDHCPLeases(); err == nil {
+		for _, lease := range dhcpLeases {
+			leases = append(leases, lease.IPaddr)
+		}
+	}
+	stale, err := freeClusterAddress(ip, leases, host)
+	if err != nil {
+		return nil, nil, err
+	}
+	for i := range stale {
+		// left behind by a node that was removed without node-manager
+		fmt.Printf("replacing stale dhcp entry of %s\n", hostname)
+		err = updateDHCPHost(network, libvirt.NETWORK_UPDATE_COMMAND_DELETE, &stale[i])
+		if err != nil {
+			return nil, nil, err
+		}
+	}
+
+	err = updateDHCPHost(network, libvirt.NETWORK_UPDATE_COMMAND_ADD_LAST, host)
+	if err != nil {
+		return nil, nil, fmt.Errorf("could not reserve %s in network %s: %s", host.IP, CLUSTER_NETWORK, err)
+	}
+	result := append([]string{}, networks...)
+	if iface.MAC == nil {
+		result[index] = fmt.Sprintf("%s,mac=%s", networks[index], host.MAC)
+	}
+	return result, host, nil
+}
+
+// freeClusterAddress sets the address of host to the first address of the
+// dhcp ranges of ip that is neither reserved for another host nor leased.
+// Entries with the hostname of host are stale and returned for removal,
+// their addresses are free again.
+func freeClusterAddress(ip *networkIP, leases []string, host *networkDHCPHost) ([]networkDHCPHost, error) {
+	used := map[string]bool{ip.Address: true}
+	for _, lease := range leases {
+		used[lease] = true
+	}
+	stale := make([]networkDHCPHost, 0)
+	for _, existing := range ip.DHCP.Hosts {
+		if strings.EqualFold(existing.MAC, host.MAC) {
+			return nil, fmt.Errorf("mac address %s is already used in network %s", host.MAC, CLUSTER_NETWORK)
+		}
+		if existing.Name == host.Name {
+			stale = append(stale, existing)
+			continue
+		}
+		used[existing.IP] = true
+	}
+
+	for _, r := range ip.DHCP.Ranges {
+		start, end := net.ParseIP(r.Start).To4(), net.ParseIP(r.End).To4()
+		if start == nil || end == nil {
+			continue
+		}
+		for i := ipToInt(start); i <= ipToInt(end); i++ {
+			if candidate := intToIP(i).String(); !used[candidate] {
+				host.IP = candidate
+				return stale, nil
+			}
+		}
+	}
+	return nil, fmt.Errorf("no free address left in network %s", CLUSTER_NETWORK)
+}
+
+// releaseClusterAddress removes the DHCP entry of a node again.
+func releaseClusterAddress(conn *libvirt.Connect, host *networkDHCPHost) error {
+	network, err := conn.LookupNetworkByName(CLUSTER_NETWORK)
+	if lverr, ok := err.(libvirt.Error); ok && lverr.Code == libvirt.ERR_NO_NETWORK {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	defer network.Free()
+	return updateDHCPHost(network, libvirt.NETWORK_UPDATE_COMMAND_DELETE, host)
+}
+
+// releaseNodeAddresses removes the DHCP entries of the interfaces of dom in
+// the cluster network.
+func releaseNodeAddresses(conn *libvirt.Connect, dom *libvirt.Domain) error {
+	domain, err := readDomainDef(dom)
+	if err != nil {
+		return err
+	}
+	macs := make([]string, 0)
+	for _, iface := range domain.Devices.Interfaces {
+		if iface.Type == "network" && iface.Source.Network == CLUSTER_NETWORK && iface.MAC != nil {
+			macs = append(macs, strings.ToLower(iface.MAC.Address))
+		}
+	}
+	if len(macs) == 0 {
+		return nil
+	}
+
+	network, err := conn.LookupNetworkByName(CLUSTER_NETWORK)
+	if lverr, ok := err.(libvirt.Error); ok && lverr.Code == libvirt.ERR_NO_NETWORK {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	defer network.Free()
+	def, err := readNetworkDef(network)
+	if err != nil {
+		return err
+	}
+	ip := def.dhcpIP()
+	if ip == nil {
+		return nil
+	}
+	for _, host := range ip.DHCP.Hosts {
+		if !stringInSlice(strings.ToLower(host.MAC), macs) {
+			continue
+		}
+		err = updateDHCPHost(network, libvirt.NETWORK_UPDATE_COMMAND_DELETE, &host)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func updateDHCPHost(network *libvirt.Network, cmd libvirt.NetworkUpdateCommand, host *networkDHCPHost) error {
+	hostXML, err := xml.Marshal(host)
+	if err != nil {
+		return err
+	}
+	flags := libvirt.NETWORK_UPDATE_AFFECT_CONFIG
+	if active, err := network.IsActive(); err == nil && active {
+		flags |= libvirt.NETWORK_UPDATE_AFFECT_LIVE
+	}
+	return network.Update(cmd, libvirt.NETWORK_SECTION_IP_DHCP_HOST, -1, string(hostXML), flags)
+}
+
+func readNetworkDef(network *libvirt.Network) (*networkDef, error) {
+	raw, err := network.GetXMLDesc(libvirt.NETWORK_XML_INACTIVE)
+	if err != nil {
+		return nil, err
+	}
+	def := &networkDef{}
+	err = xml.Unmarshal([]byte(raw), def)
+	if err != nil {
+		return nil, err
+	}
+	return def, nil
+}
+
+// dhcpIP returns the IPv4 address block of the network that serves DHCP.
+func (d *networkDef) dhcpIP() *networkIP {
+	for i, ip := range d.IPs {
+		if ip.DHCP != nil && len(ip.DHCP.Ranges) > 0 && net.ParseIP(ip.Address).To4() != nil {
+			return &d.IPs[i]
+		}
+	}
+	return nil
+}
+
+// randomMAC returns a mac address with the prefix of QEMU.
+func randomMAC() (string, error) {
+	suffix := make([]byte, 3)
+	_, err := rand.Read(suffix)
+	if err != nil {
+		return "", err
+	}
+	return fmt.Sprintf("52:54:00:%02x:%02x:%02x", suffix[0], suffix[1], suffix[2]), nil
+}
+
+func ipToInt(ip net.IP) uint32 {
+	return binary.BigEndian.Uint32(ip.To4())
+}
+
+func intToIP(i uint32) net.IP {
+	ip := make(net.IP, 4)
+	binary.BigEndian.PutUint32(ip, i)
+	return ip
+}
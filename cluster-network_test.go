@@ -0,0 +1,156 @@
+package main
+
+import (
+	"encoding/xml"
+	"strings"
+	"testing"
+)
+
+func TestNewClusterNetworkDef(t *testing.T) {
+	cases := []struct {
+		settings clusterNetworkConfig
+		expected string
+	}{
+		{
+			clusterNetworkConfig{},
+			`<network><name>node-manager</name><forward mode="nat"></forward><ip address="192.168.150.1" prefix="24"><dhcp><range start="192.168.150.2" end="192.168.150.254"></range></dhcp></ip></network>`,
+		},
+		{
+			clusterNetworkConfig{Subnet: "10.1.2.3/29", Isolated: true, Domain: "cluster.test"},
+			`<network><name>node-manager</name><domain name="cluster.test" localOnly="yes"></domain><ip address="10.1.2.1" prefix="29"><dhcp><range start="10.1.2.2" end="10.1.2.6"></range></dhcp></ip></network>`,
+		},
+		{
+			clusterNetworkConfig{Subnet: "172.16.0.0/16", DHCPStart: "172.16.1.0", DHCPEnd: "172.16.1.255"},
+			`<network><name>node-manager</name><forward mode="nat"></forward><ip address="172.16.0.1" prefix="16"><dhcp><range start="172.16.1.0" end="172.16.1.255"></range></dhcp></ip></network>`,
+		},
+		{
+			clusterNetworkConfig{Subnet: "192.168.150.0/24", DHCPStart: "192.168.150.100", DHCPEnd: "192.168.150.100"},
+			`<network><name>node-manager</name><forward mode="nat"></forward><ip address="192.168.150.1" prefix="24"><dhcp><range start="192.168.150.100" end="192.168.150.100"></range></dhcp></ip></network>`,
+		},
+	}
+	for _, c := range cases {
+		def, err := newClusterNetworkDef(c.settings)
+		if err != nil {
+			t.Errorf("%+v: %s", c.settings, err)
+			continue
+		}
+		out, err := xml.Marshal(def)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if string(out) != c.expected {
+			t.Errorf("%+v: got\n%s\nexpected\n%s", c.settings, out, c.expected)
+		}
+	}
+}
+
+func TestNewClusterNetworkDefRejectsInvalidSettings(t *testing.T) {
+	cases := []struct {
+		settings clusterNetworkConfig
+		message  string
+	}{
+		{clusterNetworkConfig{Subnet: "192.168.150.0"}, "invalid subnet"},
+		{clusterNetworkConfig{Subnet: "fd00::/64"}, "Only IPv4"},
+		{clusterNetworkConfig{Subnet: "192.168.150.0/30"}, "too small"},
+		{clusterNetworkConfig{Subnet: "192.168.150.0/32"}, "too small"},
+		{clusterNetworkConfig{DHCPStart: "192.168.151.10"}, "invalid dhcp address"},
+		{clusterNetworkConfig{DHCPEnd: "10.0.0.1"}, "invalid dhcp address"},
+		{clusterNetworkConfig{DHCPStart: "192.168.150.1"}, "invalid dhcp address"},
+		{clusterNetworkConfig{DHCPStart: "192.168.150.0"}, "invalid dhcp address"},
+		{clusterNetworkConfig{DHCPEnd: "192.168.150.255"}, "invalid dhcp address"},
+		{clusterNetworkConfig{DHCPStart: "fd00::10"}, "invalid dhcp address"},
+		{clusterNetworkConfig{DHCPStart: "node"}, "invalid dhcp address"},
+		{clusterNetworkConfig{DHCPStart: "192.168.150.200", DHCPEnd: "192.168.150.100"}, "is empty"},
+	}
+	for _, c := range cases {
+		_, err := newClusterNetworkDef(c.settings)
+		if err == nil || !strings.Contains(err.Error(), c.message) {
+			t.Errorf("%+v: got %v, expected an error about %s", c.settings, err, c.message)
+		}
+	}
+}
+
+func testClusterIP(hosts ...networkDHCPHost) *networkIP {
+	return &networkIP{
+		Address: "192.168.150.1",
+		Prefix:  24,
+		DHCP: &networkDHCP{
+			Ranges: []networkDHCPRange{{Start: "192.168.150.2", End: "192.168.150.4"}, {Start: "192.168.150.10", End: "192.168.150.11"}},
+			Hosts:  hosts,
+		},
+	}
+}
+
+func TestFreeClusterAddress(t *testing.T) {
+	cases := []struct {
+		name     string
+		hosts    []networkDHCPHost
+		leases   []string
+		expected string
+		stale    []string
+	}{
+		{"first address", nil, nil, "192.168.150.2", nil},
+		{"skips leases", nil, []string{"192.168.150.2", "192.168.150.3"}, "192.168.150.4", nil},
+		{
+			"skips dhcp hosts",
+			[]networkDHCPHost{{MAC: "52:54:00:00:00:02", Name: "atomic-host2", IP: "192.168.150.2"}},
+			[]string{"192.168.150.3"},
+			"192.168.150.4",
+			nil,
+		},
+		{
+			"continues in the next range",
+			[]networkDHCPHost{{MAC: "52:54:00:00:00:02", Name: "atomic-host2", IP: "192.168.150.2"}, {MAC: "52:54:00:00:00:03", Name: "atomic-host3", IP: "192.168.150.3"}},
+			[]string{"192.168.150.4"},
+			"192.168.150.10",
+			nil,
+		},
+		{
+			"replaces a stale entry",
+			[]networkDHCPHost{{MAC: "52:54:00:00:00:02", Name: "atomic-host2", IP: "192.168.150.2"}, {MAC: "52:54:00:00:00:09", Name: "atomic-host1", IP: "192.168.150.3"}},
+			nil,
+			"192.168.150.3",
+			[]string{"52:54:00:00:00:09"},
+		},
+		{
+			"keeps the leased address of a stale entry",
+			[]networkDHCPHost{{MAC: "52:54:00:00:00:09", Name: "atomic-host1", IP: "192.168.150.2"}},
+			[]string{"192.168.150.2"},
+			"192.168.150.3",
+			[]string{"52:54:00:00:00:09"},
+		},
+	}
+	for _, c := range cases {
+		host := &networkDHCPHost{MAC: "52:54:00:00:00:01", Name: "atomic-host1"}
+		stale, err := freeClusterAddress(testClusterIP(c.hosts...), c.leases, host)
+		if err != nil {
+			t.Errorf("%s: %s", c.name, err)
+			continue
+		}
+		if host.IP != c.expected {
+			t.Errorf("%s: got %s, expected %s", c.name, host.IP, c.expected)
+		}
+		macs := make([]string, len(stale))
+		for i, entry := range stale {
+			macs[i] = entry.MAC
+		}
+		if strings.Join(macs, ",") != strings.Join(c.stale, ",") {
+			t.Errorf("%s: got stale entries %q, expected %q", c.name, macs, c.stale)
+		}
+	}
+}
+
+func TestFreeClusterAddressFails(t *testing.T) {
+	host := &networkDHCPHost{MAC: "52:54:00:00:00:01", Name: "atomic-host1"}
+	leases := []string{"192.168.150.2", "192.168.150.3", "192.168.150.4", "192.168.150.10", "192.168.150.11"}
+	_, err := freeClusterAddress(testClusterIP(), leases, host)
+	if err == nil || !strings.Contains(err.Error(), "no free address") {
+		t.Errorf("a full network resulted in %v", err)
+	}
+
+	taken := networkDHCPHost{MAC: "52:54:00:00:00:01", Name: "atomic-host2", IP: "192.168.150.2"}
+	_, err = freeClusterAddress(testClusterIP(taken), nil, host)
+	if err == nil || !strings.Contains(err.Error(), "already used") {
+		t.Errorf("a duplicate mac address resulted in %v", err)
+	}
+}
@@ -0,0 +1,108 @@
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"path/filepath"
+	"strings"
+
+	"github.com/BurntSushi/toml"
+	yaml "gopkg.in/yaml.v2"
+)
+
+type clusterSpec struct {
+	Name   string      `yaml:"name" toml:"name"`
+	Groups []groupSpec `yaml:"groups" toml:"groups"`
+}
+
+type groupSpec struct {
+	Name         string   `yaml:"name" toml:"name"`
+	Count        int      `yaml:"count" toml:"count"`
+	Flavor       string   `yaml:"flavor" toml:"flavor"`
+	Memory       int      `yaml:"memory" toml:"memory"`
+	CPUs         int      `yaml:"cpus" toml:"cpus"`
+	DiskSize     string   `yaml:"disk-size" toml:"disk-size"`
+	Networks     []string `yaml:"networks" toml:"networks"`
+	Image        string   `yaml:"image" toml:"image"`
+	UserData     []string `yaml:"user-data" toml:"user-data"`
+	PasswordAuth bool     `yaml:"password-auth" toml:"password-auth"`
+	SSHKeys      []string `yaml:"ssh-keys" toml:"ssh-keys"`
+}
+
+// readClusterSpec reads a YAML or, for files ending in .toml, a TOML
+// cluster file. Unknown keys are rejected in both.
+func readClusterSpec(location string) (*clusterSpec, error) {
+	content, err := ioutil.ReadFile(location)
+	if err != nil {
+		return nil, err
+	}
+	spec := &clusterSpec{}
+	switch strings.ToLower(filepath.Ext(location)) {
+	case ".yaml", ".yml":
+		err = yaml.UnmarshalStrict(content, spec)
+	case ".toml":
+		var meta toml.MetaData
+		meta, err = toml.Decode(string(content), spec)
+		if undecoded := meta.Undecoded(); err == nil && len(undecoded) > 0 {
+			err = fmt.Errorf("unknown key %s", undecoded[0])
+		}
+	default:
+		return nil, fmt.Errorf("unsupported cluster file %s. Use a .yaml, .yml or .toml file", location)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("could not parse cluster file %s: %s", location, err)
+	}
+	// user-data templates are relative to the cluster file
+	for i := range spec.Groups {
+		for j, file := range spec.Groups[i].UserData {
+			if !filepath.IsAbs(file) {
+				spec.Groups[i].UserData[j] = filepath.Join(filepath.Dir(location), file)
+			}
+		}
+	}
+	return spec, spec.validate()
+}
+
+func (s *clusterSpec) validate() error {
+	seen := make(map[string]bool)
+	for _, group := range s.Groups {
+		if group.Name == "" {
+			return fmt.Errorf("every group needs a name")
+		}
+		if seen[group.Name] {
+			return fmt.Errorf("group %s is defined more than once", group.Name)
+		}
+		seen[group.Name] = true
+		if group.Count < 0 || group.Memory < 0 || group.CPUs < 0 {
+			return fmt.Errorf("group %s: count, memory and cpus must not be negative", group.Name)
+		}
+		if _, err := parseImageRef(group.Image); err != nil {
+			return fmt.Errorf("group %s: %s", group.Name, err)
+		}
+	}
+	return nil
+}
+
+func (g *groupSpec) nodeOptions(conf *config, cluster string) (nodeOptions, error) {
+	opts := defaultNodeOptions()
+	opts.group = g.Name
+	opts.cluster = cluster
+	opts.userData = g.UserData
+	opts.passwordAuth = g.PasswordAuth
+	opts.sshKeys = g.SSHKeys
+	err := opts.applyFlavor(conf, g.Flavor, g.Memory, g.CPUs, g.DiskSize)
+	if err != nil {
+		return opts, fmt.Errorf("group %s: %s", g.Name, err)
+	}
+	if len(g.Networks) != 0 {
+		opts.networks = g.Networks
+	}
+	if g.Image != "" {
+		opts.image, err = parseImageRef(g.Image)
+		if err != nil {
+			return opts, fmt.Errorf("group %s: %s", g.Name, err)
+		}
+	}
+	opts.image = opts.image.withDefaultVersion(conf)
+	return opts, nil
+}
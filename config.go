@@ -0,0 +1,75 @@
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+
+	yaml "gopkg.in/yaml.v2"
+)
+
+type config struct {
+	ImageSources []sourceConfig    `yaml:"image-sources"`
+	Flavors      map[string]flavor `yaml:"flavors"`
+	// ImageVersions pins the version of an image source that is used when
+	// no version is asked for.
+	ImageVersions map[string]string `yaml:"image-versions"`
+	// Mirrors replace the location of the index and the images of an image
+	// source, e.g. with file:///srv/images on machines without internet.
+	Mirrors map[string]string `yaml:"mirrors"`
+	// Keyring holds the public keys that index signatures are checked
+	// against. Defaults to keyring.gpg in the working directory. The keys of
+	// builtin sources like centos-atomic are trusted in addition and need no
+	// keyring.
+	Keyring string `yaml:"keyring"`
+	// ClusterNetwork holds the defaults of network create.
+	ClusterNetwork clusterNetworkConfig `yaml:"cluster-network"`
+	// AddressPools hand out static addresses to the interfaces of nodes in
+	// a network, e.g. bridge=bridge0.
+	AddressPools []addressPool `yaml:"address-pools"`
+}
+
+type addressPool struct {
+	Network string   `yaml:"network"`
+	Subnet  string   `yaml:"subnet"`
+	Start   string   `yaml:"start"`
+	End     string   `yaml:"end"`
+	Gateway string   `yaml:"gateway"`
+	DNS     []string `yaml:"dns"`
+}
+
+type clusterNetworkConfig struct {
+	Subnet    string `yaml:"subnet"`
+	DHCPStart string `yaml:"dhcp-start"`
+	DHCPEnd   string `yaml:"dhcp-end"`
+	Domain    string `yaml:"domain"`
+	Isolated  bool   `yaml:"isolated"`
+}
+
+type sourceConfig struct {
+	Name         string `yaml:"name"`
+	ChecksumURL  string `yaml:"checksum-url"`
+	SignatureURL string `yaml:"signature-url"`
+	Keyring      string `yaml:"keyring"`
+	BaseURL      string `yaml:"base-url"`
+	Pattern      string `yaml:"pattern"`
+	Arch         string `yaml:"arch"`
+	User         string `yaml:"user"`
+}
+
+func readConfig(workDir string) (*config, error) {
+	location := fmt.Sprintf("%s/config.yaml", workDir)
+	conf := &config{}
+	content, err := ioutil.ReadFile(location)
+	if os.IsNotExist(err) {
+		return conf, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	err = yaml.UnmarshalStrict(content, conf)
+	if err != nil {
+		return nil, fmt.Errorf("could not parse %s: %s", location, err)
+	}
+	return conf, nil
+}
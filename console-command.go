@@ -0,0 +1,220 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"net/url"
+	"os"
+	"os/exec"
+	"runtime"
+	"strconv"
+	"strings"
+
+	libvirt "github.com/libvirt/libvirt-go"
+	"github.com/urfave/cli"
+)
+
+// CONSOLE_ESCAPE is Ctrl+], which detaches from a console like in virsh.
+const CONSOLE_ESCAPE = 0x1d
+
+func vncCommand(c *cli.Context) error {
+	if c.NArg() != 1 {
+		return fmt.Errorf("expected exactly one node id")
+	}
+	conn, err := connect(c)
+	if err != nil {
+		log.Fatal(err)
+	}
+	defer conn.Close()
+
+	dom, err := lookupNode(conn, c.Args().First())
+	if err != nil {
+		return err
+	}
+	defer dom.Free()
+	address, err := vncAddress(dom)
+	if err != nil {
+		return err
+	}
+
+	// the display only listens on the loopback interface of the hypervisor
+	remote, err := isRemoteConnection(conn)
+	if err != nil {
+		return err
+	}
+	if remote {
+		uri, err := conn.GetURI()
+		if err != nil {
+			return err
+		}
+		parsed, err := url.Parse(uri)
+		if err != nil {
+			return err
+		}
+		_, port, _ := net.SplitHostPort(address)
+		host := parsed.Hostname()
+		if parsed.User != nil {
+			host = parsed.User.Username() + "@" + host
+		}
+		fmt.Fprintf(os.Stderr, "the display is only reachable on %s. Forward it with: ssh -N -L %s:%s %s\n", parsed.Hostname(), port, address, host)
+		address = net.JoinHostPort("127.0.0.1", port)
+	}
+
+	uri := "vnc://" + address
+	if !c.Bool("open") {
+		fmt.Println(uri)
+		return nil
+	}
+	opener := "xdg-open"
+	if runtime.GOOS == "darwin" {
+		opener = "open"
+	}
+	return exec.Command(opener, uri).Start()
+}
+
+// vncAddress reads the address of the VNC display of a running node from
+// its live description.
+func vncAddress(dom *libvirt.Domain) (string, error) {
+	def, err := readDomainDef(dom)
+	if err != nil {
+		return "", err
+	}
+	for _, graphics := range def.Devices.Graphics {
+		if graphics.Type != "vnc" {
+			continue
+		}
+		if graphics.Port <= 0 {
+			return "", fmt.Errorf("%s is not running", def.Name)
+		}
+		listen := graphics.Listen
+		if listen == "" || listen == "0.0.0.0" {
+			listen = "127.0.0.1"
+		}
+		return net.JoinHostPort(listen, strconv.Itoa(graphics.Port)), nil
+	}
+	return "", fmt.Errorf("%s has no VNC display", def.Name)
+}
+
+func consoleCommand(c *cli.Context) error {
+	if c.NArg() != 1 {
+		return fmt.Errorf("expected exactly one node id")
+	}
+	conn, err := connect(c)
+	if err != nil {
+		log.Fatal(err)
+	}
+	defer conn.Close()
+
+	dom, err := lookupNode(conn, c.Args().First())
+	if err != nil {
+		return err
+	}
+	defer dom.Free()
+	name, err := dom.GetName()
+	if err != nil {
+		return err
+	}
+	active, err := dom.IsActive()
+	if err != nil {
+		return err
+	}
+	if !active {
+		return fmt.Errorf("%s is not running", name)
+	}
+
+	stream, err := conn.NewStream(0)
+	if err != nil {
+		return err
+	}
+	defer stream.Free()
+	flags := libvirt.DOMAIN_CONSOLE_SAFE
+	if c.Bool("force") {
+		flags |= libvirt.DOMAIN_CONSOLE_FORCE
+	}
+	err = dom.OpenConsole("", stream, flags)
+	if err != nil {
+		return fmt.Errorf("could not open the console of %s: %s", name, err)
+	}
+
+	fmt.Printf("connected to the console of %s. Press Ctrl+] to detach.\n", name)
+	restore := makeRaw()
+	defer restore()
+
+	done := make(chan error, 2)
+	go func() {
+		buf := make([]byte, 4096)
+		for {
+			n, err := stream.Recv(buf)
+			if n > 0 {
+				os.Stdout.Write(buf[:n])
+			}
+			if err != nil || n == 0 {
+				done <- err
+				return
+			}
+		}
+	}()
+	go func() {
+		buf := make([]byte, 1024)
+		for {
+			n, err := os.Stdin.Read(buf)
+			input := buf[:n]
+			detach := false
+			if i := bytes.IndexByte(input, CONSOLE_ESCAPE); i >= 0 {
+				input = input[:i]
+				detach = true
+			}
+			if len(input) > 0 {
+				_, sendErr := stream.Send(input)
+				if sendErr != nil {
+					done <- sendErr
+					return
+				}
+			}
+			if detach || err == io.EOF {
+				done <- nil
+				return
+			}
+			if err != nil {
+				done <- err
+				return
+			}
+		}
+	}()
+
+	err = <-done
+	stream.Abort()
+	restore()
+	fmt.Println()
+	return err
+}
+
+// makeRaw puts the terminal into raw mode, so that every key reaches the
+// node as it is typed. The returned function restores the previous mode.
+// Input that is not a terminal is left alone.
+func makeRaw() func() {
+	save := exec.Command("stty", "-g")
+	save.Stdin = os.Stdin
+	state, err := save.Output()
+	if err != nil {
+		return func() {}
+	}
+	raw := exec.Command("stty", "raw", "-echo")
+	raw.Stdin = os.Stdin
+	if raw.Run() != nil {
+		return func() {}
+	}
+	restored := false
+	return func() {
+		if restored {
+			return
+		}
+		restored = true
+		restore := exec.Command("stty", strings.TrimSpace(string(state)))
+		restore.Stdin = os.Stdin
+		restore.Run()
+	}
+}
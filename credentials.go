@@ -0,0 +1,72 @@
+package main
+
+import (
+	"crypto/rand"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"math/big"
+	"os"
+	"strings"
+
+	"github.com/urfave/cli"
+)
+
+const PASSWORD_CHARS = "abcdefghijkmnopqrstuvwxyzABCDEFGHJKLMNPQRSTUVWXYZ23456789"
+
+func credentialsCommand(c *cli.Context) error {
+	if c.NArg() != 1 {
+		return fmt.Errorf("expected exactly one node id")
+	}
+	conn, err := connect(c)
+	if err != nil {
+		log.Fatal(err)
+	}
+	defer conn.Close()
+
+	dom, err := lookupNode(conn, c.Args().First())
+	if err != nil {
+		return err
+	}
+	defer dom.Free()
+	name, err := dom.GetName()
+	if err != nil {
+		return err
+	}
+	meta, err := getNodeMetadata(dom)
+	if err != nil {
+		return err
+	}
+
+	password, err := ioutil.ReadFile(passwordFile(fmt.Sprintf("%s/images/%s", getProjectDir(c), name)))
+	if os.IsNotExist(err) {
+		return fmt.Errorf("no password stored for %s", name)
+	}
+	if err != nil {
+		return err
+	}
+	if meta.User != "" {
+		fmt.Printf("user:     %s\n", meta.User)
+	}
+	fmt.Printf("password: %s\n", strings.TrimSpace(string(password)))
+	return nil
+}
+
+func passwordFile(nodeDir string) string {
+	return fmt.Sprintf("%s/password", nodeDir)
+}
+
+// generatePassword returns a random password without characters that are
+// easily confused on a console.
+func generatePassword() (string, error) {
+	password := make([]byte, 20)
+	max := big.NewInt(int64(len(PASSWORD_CHARS)))
+	for i := range password {
+		n, err := rand.Int(rand.Reader, max)
+		if err != nil {
+			return "", err
+		}
+		password[i] = PASSWORD_CHARS[n.Int64()]
+	}
+	return string(password), nil
+}
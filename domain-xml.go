@@ -0,0 +1,337 @@
+package main
+
+import (
+	"encoding/xml"
+	"fmt"
+	"net"
+	"strings"
+
+	libvirt "github.com/libvirt/libvirt-go"
+)
+
+type domainDef struct {
+	XMLName  xml.Name       `xml:"domain"`
+	Type     string         `xml:"type,attr"`
+	Name     string         `xml:"name"`
+	Memory   domainMemory   `xml:"memory"`
+	VCPU     int            `xml:"vcpu"`
+	OS       domainOS       `xml:"os"`
+	Features domainFeatures `xml:"features"`
+	Devices  domainDevices  `xml:"devices"`
+	// QemuCommandline passes arguments straight to qemu
+	QemuCommandline *qemuCommandline `xml:"http://libvirt.org/schemas/domain/qemu/1.0 commandline"`
+}
+
+type qemuCommandline struct {
+	Args []qemuArg `xml:"http://libvirt.org/schemas/domain/qemu/1.0 arg"`
+}
+
+type qemuArg struct {
+	Value string `xml:"value,attr"`
+}
+
+// IGNITION_FW_CFG is the fw_cfg entry Fedora CoreOS reads its Ignition
+// config from.
+const IGNITION_FW_CFG = "opt/com.coreos/config"
+
+type domainMemory struct {
+	Unit  string `xml:"unit,attr"`
+	Value int    `xml:",chardata"`
+}
+
+type domainOS struct {
+	Type string       `xml:"type"`
+	Boot []domainBoot `xml:"boot"`
+}
+
+type domainBoot struct {
+	Dev string `xml:"dev,attr"`
+}
+
+type domainFeatures struct {
+	ACPI *struct{} `xml:"acpi"`
+	APIC *struct{} `xml:"apic"`
+}
+
+type domainDevices struct {
+	Disks      []domainDisk      `xml:"disk"`
+	Interfaces []domainInterface `xml:"interface"`
+	Graphics   []domainGraphics  `xml:"graphics"`
+	Serials    []domainSerial    `xml:"serial"`
+	Consoles   []domainConsole   `xml:"console"`
+	Channels   []domainChannel   `xml:"channel"`
+}
+
+type domainDisk struct {
+	Type     string           `xml:"type,attr"`
+	Device   string           `xml:"device,attr"`
+	Driver   domainDiskDriver `xml:"driver"`
+	Source   domainDiskSource `xml:"source"`
+	Target   domainDiskTarget `xml:"target"`
+	ReadOnly *struct{}        `xml:"readonly"`
+}
+
+type domainDiskDriver struct {
+	Name string `xml:"name,attr"`
+	Type string `xml:"type,attr"`
+}
+
+type domainDiskSource struct {
+	File string `xml:"file,attr"`
+}
+
+type domainDiskTarget struct {
+	Dev string `xml:"dev,attr"`
+	Bus string `xml:"bus,attr"`
+}
+
+type domainInterface struct {
+	Type   string                `xml:"type,attr"`
+	MAC    *domainInterfaceMAC   `xml:"mac"`
+	Source domainInterfaceSource `xml:"source"`
+	Model  domainInterfaceModel  `xml:"model"`
+}
+
+type domainInterfaceMAC struct {
+	Address string `xml:"address,attr"`
+}
+
+type domainInterfaceSource struct {
+	Network string `xml:"network,attr,omitempty"`
+	Bridge  string `xml:"bridge,attr,omitempty"`
+	Dev     string `xml:"dev,attr,omitempty"`
+	Mode    string `xml:"mode,attr,omitempty"`
+}
+
+type domainInterfaceModel struct {
+	Type string `xml:"type,attr"`
+}
+
+type domainGraphics struct {
+	Type     string `xml:"type,attr"`
+	Port     int    `xml:"port,attr"`
+	AutoPort string `xml:"autoport,attr,omitempty"`
+	Listen   string `xml:"listen,attr"`
+}
+
+type domainSerial struct {
+	Type   string             `xml:"type,attr"`
+	Log    *domainLog         `xml:"log"`
+	Target domainSerialTarget `xml:"target"`
+}
+
+type domainLog struct {
+	File   string `xml:"file,attr"`
+	Append string `xml:"append,attr,omitempty"`
+}
+
+type domainSerialTarget struct {
+	Port int `xml:"port,attr"`
+}
+
+type domainConsole struct {
+	Type   string              `xml:"type,attr"`
+	Target domainConsoleTarget `xml:"target"`
+}
+
+type domainConsoleTarget struct {
+	Type string `xml:"type,attr"`
+	Port int    `xml:"port,attr"`
+}
+
+type domainChannel struct {
+	Type   string              `xml:"type,attr"`
+	Target domainChannelTarget `xml:"target"`
+}
+
+type domainChannelTarget struct {
+	Type string `xml:"type,attr"`
+	Name string `xml:"name,attr"`
+}
+
+// newDomainDef describes a node booting from diskPath with the cloud-init
+// seed in seedPath attached as cdrom. For Ignition images, seedPath is the
+// Ignition config, which qemu hands to the node through fw_cfg. libvirt
+// picks a free VNC port whenever the node starts. The output of the serial
+// console is appended to consoleLog, unless it is empty.
+func newDomainDef(name string, opts nodeOptions, diskPath, seedPath, consoleLog string) (*domainDef, error) {
+	def := &domainDef{
+		Type:   "kvm",
+		Name:   name,
+		Memory: domainMemory{Unit: "MiB", Value: opts.memory},
+		VCPU:   opts.cpus,
+		OS: domainOS{
+			Type: "hvm",
+			Boot: []domainBoot{{Dev: "hd"}, {Dev: "cdrom"}},
+		},
+		Features: domainFeatures{ACPI: &struct{}{}, APIC: &struct{}{}},
+		Devices: domainDevices{
+			Disks: []domainDisk{
+				{
+					Type:   "file",
+					Device: "disk",
+					Driver: domainDiskDriver{Name: "qemu", Type: "qcow2"},
+					Source: domainDiskSource{File: diskPath},
+					Target: domainDiskTarget{Dev: "vda", Bus: "virtio"},
+				},
+				{
+					Type:     "file",
+					Device:   "cdrom",
+					Driver:   domainDiskDriver{Name: "qemu", Type: "raw"},
+					Source:   domainDiskSource{File: seedPath},
+					Target:   domainDiskTarget{Dev: "sda", Bus: "sata"},
+					ReadOnly: &struct{}{},
+				},
+			},
+			Graphics: []domainGraphics{
+				{Type: "vnc", Port: -1, AutoPort: "yes", Listen: "127.0.0.1"},
+			},
+			Serials: []domainSerial{
+				{Type: "pty", Target: domainSerialTarget{Port: 0}},
+			},
+			Consoles: []domainConsole{
+				{Type: "pty", Target: domainConsoleTarget{Type: "serial", Port: 0}},
+			},
+			Channels: []domainChannel{
+				{Type: "unix", Target: domainChannelTarget{Type: "virtio", Name: "org.qemu.guest_agent.0"}},
+			},
+		},
+	}
+
+	if opts.ignition {
+		def.OS.Boot = def.OS.Boot[:1]
+		def.Devices.Disks = def.Devices.Disks[:1]
+		def.QemuCommandline = &qemuCommandline{Args: []qemuArg{
+			{Value: "-fw_cfg"},
+			// commas separate the options of qemu and are doubled in values
+			{Value: fmt.Sprintf("name=%s,file=%s", IGNITION_FW_CFG, strings.Replace(seedPath, ",", ",,", -1))},
+		}}
+	}
+
+	if consoleLog != "" {
+		def.Devices.Serials[0].Log = &domainLog{File: consoleLog, Append: "on"}
+	}
+
+	for _, network := range opts.networks {
+		iface, err := parseNetwork(network)
+		if err != nil {
+			return nil, err
+		}
+		if iface != nil {
+			def.Devices.Interfaces = append(def.Devices.Interfaces, *iface)
+		}
+	}
+	return def, nil
+}
+
+// parseNetwork understands the network notation of virt-install, that is
+// bridge=<bridge>, network=<libvirt network> or macvtap=<host device>,
+// optionally followed by ,mac=<address>. none results in no interface.
+func parseNetwork(raw string) (*domainInterface, error) {
+	if raw == "none" {
+		return nil, nil
+	}
+	iface := &domainInterface{Model: domainInterfaceModel{Type: "virtio"}}
+	options := strings.Split(raw, ",")
+	for _, option := range options[1:] {
+		parts := strings.SplitN(option, "=", 2)
+		if len(parts) != 2 || parts[0] != "mac" {
+			return nil, fmt.Errorf("invalid option %s in network %s. Only mac=<address> is supported", option, raw)
+		}
+		mac, err := net.ParseMAC(parts[1])
+		if err != nil {
+			return nil, fmt.Errorf("invalid mac address in network %s: %s", raw, err)
+		}
+		iface.MAC = &domainInterfaceMAC{Address: mac.String()}
+	}
+
+	parts := strings.SplitN(options[0], "=", 2)
+	if len(parts) != 2 || parts[1] == "" {
+		return nil, fmt.Errorf("invalid network %s. Expected bridge=<name>, network=<name>, macvtap=<device> or none", raw)
+	}
+	switch parts[0] {
+	case "bridge":
+		iface.Type = "bridge"
+		iface.Source.Bridge = parts[1]
+	case "network":
+		iface.Type = "network"
+		iface.Source.Network = parts[1]
+	case "macvtap":
+		iface.Type = "direct"
+		iface.Source.Dev = parts[1]
+		iface.Source.Mode = "bridge"
+	default:
+		return nil, fmt.Errorf("invalid network type %s in %s", parts[0], raw)
+	}
+	return iface, nil
+}
+
+// readDomainDef parses the current description of dom.
+func readDomainDef(dom *libvirt.Domain) (*domainDef, error) {
+	raw, err := dom.GetXMLDesc(0)
+	if err != nil {
+		return nil, err
+	}
+	def := &domainDef{}
+	err = xml.Unmarshal([]byte(raw), def)
+	if err != nil {
+		return nil, err
+	}
+	return def, nil
+}
+
+// notation writes the interface in the notation of parseNetwork, without
+// its mac address.
+func (i *domainInterface) notation() string {
+	switch i.Type {
+	case "bridge":
+		return "bridge=" + i.Source.Bridge
+	case "network":
+		return "network=" + i.Source.Network
+	case "direct":
+		return "macvtap=" + i.Source.Dev
+	}
+	return i.Type
+}
+
+// domainDiskPaths lists the files of all disks attached to dom and the
+// Ignition config passed to it.
+func domainDiskPaths(dom *libvirt.Domain) ([]string, error) {
+	def, err := readDomainDef(dom)
+	if err != nil {
+		return nil, err
+	}
+	paths := make([]string, 0, len(def.Devices.Disks)+1)
+	for _, disk := range def.Devices.Disks {
+		if disk.Source.File != "" {
+			paths = append(paths, disk.Source.File)
+		}
+	}
+	if config := def.ignitionConfig(); config != "" {
+		paths = append(paths, config)
+	}
+	return paths, nil
+}
+
+// ignitionConfig returns the file of the Ignition config passed through
+// fw_cfg or an empty string.
+func (d *domainDef) ignitionConfig() string {
+	if d.QemuCommandline == nil {
+		return ""
+	}
+	prefix := "name=" + IGNITION_FW_CFG + ",file="
+	for _, arg := range d.QemuCommandline.Args {
+		if strings.HasPrefix(arg.Value, prefix) {
+			return strings.Replace(strings.TrimPrefix(arg.Value, prefix), ",,", ",", -1)
+		}
+	}
+	return ""
+}
+
+func (d *domainDef) Marshal() (string, error) {
+	raw, err := xml.MarshalIndent(d, "", "  ")
+	if err != nil {
+		return "", err
+	}
+	return string(raw), nil
+}
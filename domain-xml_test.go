@@ -0,0 +1,106 @@
+package main
+
+import (
+	"flag"
+	"io/ioutil"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	libvirt "github.com/libvirt/libvirt-go"
+)
+
+var update = flag.Bool("update", false, "rewrite the golden files in testdata")
+
+type domainDefCase struct {
+	golden     string
+	networks   []string
+	ignition   bool
+	consoleLog string
+}
+
+var domainDefCases = []domainDefCase{
+	{golden: "default"},
+	{golden: "bridge", networks: []string{"bridge=br0"}},
+	{golden: "network", networks: []string{"network=default,mac=52:54:00:12:34:56"}},
+	{golden: "macvtap", networks: []string{"macvtap=eth0"}},
+	{golden: "none", networks: []string{"none"}},
+	{golden: "console-log", networks: []string{"network=default"}, consoleLog: "/nodes/atomic-host1/console.log"},
+	{golden: "ignition", networks: []string{"network=default"}, ignition: true},
+}
+
+func (c domainDefCase) marshal(t *testing.T) string {
+	opts := defaultNodeOptions()
+	opts.networks = c.networks
+	opts.ignition = c.ignition
+	seed := "/pool/atomic-host1-seed.iso"
+	if c.ignition {
+		seed = "/pool/atomic-host1.ign"
+	}
+	def, err := newDomainDef("atomic-host1", opts, "/pool/atomic-host1.qcow2", seed, c.consoleLog)
+	if err != nil {
+		t.Fatal(err)
+	}
+	out, err := def.Marshal()
+	if err != nil {
+		t.Fatal(err)
+	}
+	return out + "\n"
+}
+
+func TestDomainDefGolden(t *testing.T) {
+	for _, c := range domainDefCases {
+		out := c.marshal(t)
+		golden := filepath.Join("testdata", c.golden+".xml")
+		if *update {
+			err := ioutil.WriteFile(golden, []byte(out), 0644)
+			if err != nil {
+				t.Fatal(err)
+			}
+			continue
+		}
+		expected, err := ioutil.ReadFile(golden)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if out != string(expected) {
+			t.Errorf("%s: got\n%s\nexpected\n%s", c.golden, out, expected)
+		}
+	}
+}
+
+// TestDomainDefValidates lets libvirt check the descriptions against its
+// schema. The test driver only runs domains of type test.
+func TestDomainDefValidates(t *testing.T) {
+	conn, err := libvirt.NewConnect("test:///default")
+	if err != nil {
+		t.Skipf("libvirt is not available: %s", err)
+	}
+	defer conn.Close()
+
+	for _, c := range domainDefCases {
+		out := strings.Replace(c.marshal(t), `<domain type="kvm">`, `<domain type="test">`, 1)
+		dom, err := conn.DomainDefineXMLFlags(out, libvirt.DOMAIN_DEFINE_VALIDATE)
+		if err != nil {
+			t.Errorf("%s: %s", c.golden, err)
+			continue
+		}
+		err = dom.Undefine()
+		if err != nil {
+			t.Errorf("%s: %s", c.golden, err)
+		}
+		dom.Free()
+	}
+}
+
+func TestIgnitionConfigRoundTrip(t *testing.T) {
+	opts := defaultNodeOptions()
+	opts.ignition = true
+	def, err := newDomainDef("atomic-host1", opts, "/pool/atomic-host1.qcow2", "/pool/a,b.ign", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if config := def.ignitionConfig(); config != "/pool/a,b.ign" {
+		t.Errorf("got %s", config)
+	}
+}
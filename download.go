@@ -0,0 +1,180 @@
+package main
+
+import (
+	"crypto/sha256"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+)
+
+// httpClient also understands file:// URLs, which makes mirrors on local
+// media work like any other.
+var httpClient = newHTTPClient()
+
+func newHTTPClient() *http.Client {
+	transport := &http.Transport{
+		Proxy:               http.ProxyFromEnvironment,
+		TLSHandshakeTimeout: 10 * time.Second,
+		IdleConnTimeout:     90 * time.Second,
+	}
+	transport.RegisterProtocol("file", http.NewFileTransport(http.Dir("/")))
+	return &http.Client{Transport: transport}
+}
+
+const DOWNLOAD_ATTEMPTS = 6
+const MAX_DOWNLOAD_BACKOFF = 30 * time.Second
+
+// downloadFile fetches url into dest. The data is written to dest.part
+// first, so an interrupted download continues where it stopped with a HTTP
+// range request, also in a later run. dest only appears once the sha256 of
+// the download matches shaSum.
+func downloadFile(url, dest, shaSum string, progress *ProgressWriter) error {
+	partPath := dest + ".part"
+	backoff := time.Second
+	for attempt := 1; ; attempt++ {
+		retry, err := downloadPart(url, partPath, progress)
+		if err == nil {
+			break
+		}
+		if !retry || attempt == DOWNLOAD_ATTEMPTS {
+			return err
+		}
+		fmt.Printf("downloading %s failed: %s. Retrying in %s\n", filepath.Base(dest), err, backoff)
+		time.Sleep(backoff)
+		backoff *= 2
+		if backoff > MAX_DOWNLOAD_BACKOFF {
+			backoff = MAX_DOWNLOAD_BACKOFF
+		}
+	}
+
+	actualSha, err := fileSha256(partPath)
+	if err != nil {
+		return err
+	}
+	if actualSha != shaSum {
+		err := os.Remove(partPath)
+		if err != nil {
+			fmt.Printf("could not delete file %s. Manual cleanup necessary.\n", partPath)
+		}
+		return fmt.Errorf("Downloaded has a different sha value then the index suggests.\n This means, someone has tempered with the image.\n actual sha: %s\n expected sha: %s", actualSha, shaSum)
+	}
+	return os.Rename(partPath, dest)
+}
+
+// downloadPart appends the rest of url to partPath. It reports whether a
+// failed attempt is worth retrying.
+func downloadPart(url, partPath string, progress *ProgressWriter) (bool, error) {
+	file, err := os.OpenFile(partPath, os.O_WRONLY|os.O_CREATE, 0644)
+	if err != nil {
+		return false, err
+	}
+	defer file.Close()
+	offset, err := file.Seek(0, io.SeekEnd)
+	if err != nil {
+		return false, err
+	}
+
+	req, err := http.NewRequest("GET", url, nil)
+	if err != nil {
+		return false, err
+	}
+	if offset > 0 {
+		req.Header.Set("Range", fmt.Sprintf("bytes=%d-", offset))
+	}
+	resp, err := httpClient.Do(req)
+	if err != nil {
+		return true, err
+	}
+	defer resp.Body.Close()
+
+	switch {
+	case resp.StatusCode == http.StatusPartialContent:
+	case resp.StatusCode == http.StatusOK:
+		// the server ignored the range, start over
+		offset = 0
+		err = file.Truncate(0)
+		if err == nil {
+			_, err = file.Seek(0, io.SeekStart)
+		}
+		if err != nil {
+			return false, err
+		}
+	case resp.StatusCode == http.StatusRequestedRangeNotSatisfiable && offset > 0:
+		// nothing left to fetch, the checksum tells whether the file is complete
+		return false, nil
+	default:
+		retry := resp.StatusCode >= 500 || resp.StatusCode == http.StatusTooManyRequests
+		return retry, fmt.Errorf("could not download %s: %s", url, resp.Status)
+	}
+
+	total := int64(-1)
+	if resp.ContentLength >= 0 {
+		total = offset + resp.ContentLength
+	}
+	counter := &progressCounter{progress: progress, name: partPath, done: offset, total: total}
+	counter.progress.update(counter.name, counter.done, counter.total)
+	_, err = io.Copy(io.MultiWriter(file, counter), resp.Body)
+	if err != nil {
+		return true, err
+	}
+	if total >= 0 && counter.done != total {
+		return true, fmt.Errorf("connection closed after %d of %d bytes", counter.done, total)
+	}
+	return false, nil
+}
+
+func fileSha256(path string) (string, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return "", err
+	}
+	defer file.Close()
+	shaSink := sha256.New()
+	_, err = io.Copy(shaSink, file)
+	if err != nil {
+		return "", err
+	}
+	return fmt.Sprintf("%x", shaSink.Sum(nil)), nil
+}
+
+// downloadEntries downloads up to jobs images at the same time and reports
+// their combined progress.
+func downloadEntries(workDir string, entries []*IndexEntry, jobs int) error {
+	if jobs < 1 {
+		jobs = 1
+	}
+	progress := newProgressWriter()
+	slots := make(chan struct{}, jobs)
+	results := make([]error, len(entries))
+	var wg sync.WaitGroup
+	wg.Add(len(entries))
+	for i, entry := range entries {
+		go func(i int, entry *IndexEntry) {
+			defer wg.Done()
+			slots <- struct{}{}
+			defer func() { <-slots }()
+			fmt.Println("Downloading " + entry.fileName)
+			results[i] = entry.Download(workDir, progress)
+		}(i, entry)
+	}
+	wg.Wait()
+	if len(entries) == 1 {
+		return results[0]
+	}
+
+	failed := 0
+	for i, entry := range entries {
+		if results[i] != nil {
+			failed++
+			fmt.Printf("%s: failed: %s\n", entry, results[i])
+		}
+	}
+	if failed > 0 {
+		return fmt.Errorf("%d of %d downloads failed", failed, len(entries))
+	}
+	return nil
+}
@@ -0,0 +1,154 @@
+package main
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+)
+
+// downloadServer serves content and records the Range header of every
+// request. handle may answer a request itself and returns false otherwise.
+type downloadServer struct {
+	*httptest.Server
+	lock   sync.Mutex
+	ranges []string
+}
+
+func newDownloadServer(content []byte, handle func(w http.ResponseWriter, r *http.Request, request int) bool) *downloadServer {
+	s := &downloadServer{}
+	s.Server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		s.lock.Lock()
+		s.ranges = append(s.ranges, r.Header.Get("Range"))
+		request := len(s.ranges)
+		s.lock.Unlock()
+		if handle != nil && handle(w, r, request) {
+			return
+		}
+		http.ServeContent(w, r, "image", time.Time{}, bytes.NewReader(content))
+	}))
+	return s
+}
+
+func downloadDest(t *testing.T) (string, func()) {
+	dir, err := ioutil.TempDir("", "node-manager")
+	if err != nil {
+		t.Fatal(err)
+	}
+	return filepath.Join(dir, "image.qcow2"), func() { os.RemoveAll(dir) }
+}
+
+func testContent() ([]byte, string) {
+	content := make([]byte, 100*1024)
+	for i := range content {
+		content[i] = byte(i * 7)
+	}
+	return content, fmt.Sprintf("%x", sha256.Sum256(content))
+}
+
+func checkDownload(t *testing.T, dest string, content []byte) {
+	actual, err := ioutil.ReadFile(dest)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(actual, content) {
+		t.Errorf("downloaded %d bytes that differ from the %d served", len(actual), len(content))
+	}
+	if _, err := os.Stat(dest + ".part"); !os.IsNotExist(err) {
+		t.Errorf("%s.part is left behind", dest)
+	}
+}
+
+func TestDownloadResumesPartFile(t *testing.T) {
+	content, sha := testContent()
+	server := newDownloadServer(content, nil)
+	defer server.Close()
+	dest, cleanup := downloadDest(t)
+	defer cleanup()
+	err := ioutil.WriteFile(dest+".part", content[:4000], 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	err = downloadFile(server.URL, dest, sha, newProgressWriter())
+	if err != nil {
+		t.Fatal(err)
+	}
+	checkDownload(t, dest, content)
+	if len(server.ranges) != 1 || server.ranges[0] != "bytes=4000-" {
+		t.Errorf("expected a single request for bytes=4000-, got %q", server.ranges)
+	}
+}
+
+func TestDownloadStartsOverWhenRangeIsIgnored(t *testing.T) {
+	content, sha := testContent()
+	server := newDownloadServer(content, func(w http.ResponseWriter, r *http.Request, request int) bool {
+		w.Write(content)
+		return true
+	})
+	defer server.Close()
+	dest, cleanup := downloadDest(t)
+	defer cleanup()
+	err := ioutil.WriteFile(dest+".part", []byte("stale content of another image"), 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	err = downloadFile(server.URL, dest, sha, newProgressWriter())
+	if err != nil {
+		t.Fatal(err)
+	}
+	checkDownload(t, dest, content)
+}
+
+func TestDownloadRetriesAfterDroppedConnection(t *testing.T) {
+	content, sha := testContent()
+	half := len(content) / 2
+	server := newDownloadServer(content, func(w http.ResponseWriter, r *http.Request, request int) bool {
+		if request > 1 {
+			return false
+		}
+		w.Header().Set("Content-Length", fmt.Sprint(len(content)))
+		w.Write(content[:half])
+		w.(http.Flusher).Flush()
+		// closes the connection in the middle of the body
+		panic(http.ErrAbortHandler)
+	})
+	defer server.Close()
+	dest, cleanup := downloadDest(t)
+	defer cleanup()
+
+	err := downloadFile(server.URL, dest, sha, newProgressWriter())
+	if err != nil {
+		t.Fatal(err)
+	}
+	checkDownload(t, dest, content)
+	if len(server.ranges) != 2 || server.ranges[1] != fmt.Sprintf("bytes=%d-", half) {
+		t.Errorf("expected a retry for bytes=%d-, got %q", half, server.ranges)
+	}
+}
+
+func TestDownloadRejectsChecksumMismatch(t *testing.T) {
+	content, _ := testContent()
+	server := newDownloadServer(content, nil)
+	defer server.Close()
+	dest, cleanup := downloadDest(t)
+	defer cleanup()
+
+	err := downloadFile(server.URL, dest, fmt.Sprintf("%x", sha256.Sum256(nil)), newProgressWriter())
+	if err == nil {
+		t.Fatal("a download with the wrong checksum succeeded")
+	}
+	for _, path := range []string{dest, dest + ".part"} {
+		if _, err := os.Stat(path); !os.IsNotExist(err) {
+			t.Errorf("%s is left behind", path)
+		}
+	}
+}
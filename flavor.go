@@ -0,0 +1,95 @@
+package main
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+
+	"github.com/urfave/cli"
+)
+
+const DEFAULT_FLAVOR = "medium"
+
+type flavor struct {
+	Memory   int    `yaml:"memory"`
+	CPUs     int    `yaml:"cpus"`
+	DiskSize string `yaml:"disk-size"`
+}
+
+var builtinFlavors = map[string]flavor{
+	"small":  {Memory: 2048, CPUs: 2, DiskSize: "10G"},
+	"medium": {Memory: 4096, CPUs: 4, DiskSize: "20G"},
+	"large":  {Memory: 8192, CPUs: 8, DiskSize: "40G"},
+}
+
+func lookupFlavor(conf *config, name string) (flavor, error) {
+	if f, ok := conf.Flavors[name]; ok {
+		return f, nil
+	}
+	if f, ok := builtinFlavors[name]; ok {
+		return f, nil
+	}
+	return flavor{}, fmt.Errorf("unknown flavor %s", name)
+}
+
+// applyFlavor sets the sizing of opts to the named flavor. Explicit sizes
+// in memory, cpus and diskSize take precedence over the flavor.
+func (opts *nodeOptions) applyFlavor(conf *config, name string, memory, cpus int, diskSize string) error {
+	if name == "" {
+		name = DEFAULT_FLAVOR
+	}
+	f, err := lookupFlavor(conf, name)
+	if err != nil {
+		return err
+	}
+	opts.flavor = name
+	opts.memory = f.Memory
+	opts.cpus = f.CPUs
+	if memory != 0 {
+		opts.memory = memory
+	}
+	if cpus != 0 {
+		opts.cpus = cpus
+	}
+	if diskSize == "" {
+		diskSize = f.DiskSize
+	}
+	if diskSize != "" {
+		opts.diskSize, err = parseSize(diskSize)
+		if err != nil {
+			return err
+		}
+	}
+	if opts.memory <= 0 || opts.cpus <= 0 {
+		return fmt.Errorf("flavor %s needs a positive amount of memory and cpus", name)
+	}
+	return nil
+}
+
+func (opts *nodeOptions) applyFlavorFlags(c *cli.Context, conf *config) error {
+	return opts.applyFlavor(conf, c.String("flavor"), c.Int("memory"), c.Int("cpus"), c.String("disk-size"))
+}
+
+// parseSize parses sizes like 512M, 20G or 1T into bytes. Numbers without a
+// unit are GiB.
+func parseSize(raw string) (uint64, error) {
+	units := map[string]uint64{
+		"K": 1 << 10,
+		"M": 1 << 20,
+		"G": 1 << 30,
+		"T": 1 << 40,
+	}
+	value := strings.TrimSuffix(strings.ToUpper(strings.TrimSpace(raw)), "B")
+	unit := uint64(1 << 30)
+	if len(value) > 0 {
+		if u, ok := units[value[len(value)-1:]]; ok {
+			unit = u
+			value = value[:len(value)-1]
+		}
+	}
+	number, err := strconv.ParseUint(value, 10, 64)
+	if err != nil || number == 0 {
+		return 0, fmt.Errorf("invalid size %s", raw)
+	}
+	return number * unit, nil
+}
@@ -0,0 +1,204 @@
+package main
+
+import (
+	"crypto/rand"
+	"crypto/sha512"
+	"encoding/json"
+	"fmt"
+	"net/url"
+)
+
+const IGNITION_VERSION = "3.0.0"
+
+// ignitionConfig is the subset of the Ignition config spec 3 that nodes
+// need. Ignition replaces cloud-init on Fedora CoreOS.
+type ignitionConfig struct {
+	Ignition struct {
+		Version string `json:"version"`
+	} `json:"ignition"`
+	Passwd  ignitionPasswd  `json:"passwd"`
+	Storage ignitionStorage `json:"storage"`
+}
+
+type ignitionPasswd struct {
+	Users []ignitionUser `json:"users"`
+}
+
+type ignitionUser struct {
+	Name              string   `json:"name"`
+	PasswordHash      string   `json:"passwordHash,omitempty"`
+	SSHAuthorizedKeys []string `json:"sshAuthorizedKeys"`
+}
+
+type ignitionStorage struct {
+	Files []ignitionFile `json:"files"`
+}
+
+type ignitionFile struct {
+	Path      string               `json:"path"`
+	Mode      int                  `json:"mode"`
+	Overwrite bool                 `json:"overwrite"`
+	Contents  ignitionFileContents `json:"contents"`
+}
+
+type ignitionFileContents struct {
+	Source string `json:"source"`
+}
+
+// renderIgnition is the counterpart of defaultCloudConfig for images that
+// are provisioned with Ignition.
+func renderIgnition(user, hostname string, sshKeys []string, password string, passwordAuth bool) ([]byte, error) {
+	hash, err := hashPassword(password)
+	if err != nil {
+		return nil, err
+	}
+	conf := &ignitionConfig{}
+	conf.Ignition.Version = IGNITION_VERSION
+	conf.Passwd.Users = []ignitionUser{{Name: user, PasswordHash: hash, SSHAuthorizedKeys: sshKeys}}
+	conf.Storage.Files = []ignitionFile{ignitionDataFile("/etc/hostname", 0644, hostname+"\n")}
+	if passwordAuth {
+		conf.Storage.Files = append(conf.Storage.Files,
+			ignitionDataFile("/etc/ssh/sshd_config.d/40-node-manager.conf", 0600, "PasswordAuthentication yes\n"))
+	}
+	return json.MarshalIndent(conf, "", "  ")
+}
+
+func ignitionDataFile(path string, mode int, content string) ignitionFile {
+	return ignitionFile{
+		Path:      path,
+		Mode:      mode,
+		Overwrite: true,
+		Contents:  ignitionFileContents{Source: "data:," + url.PathEscape(content)},
+	}
+}
+
+const CRYPT_ALPHABET = "./0123456789ABCDEFGHIJKLMNOPQRSTUVWXYZabcdefghijklmnopqrstuvwxyz"
+
+// hashPassword hashes password with SHA-512 crypt, which /etc/shadow
+// understands everywhere.
+func hashPassword(password string) (string, error) {
+	raw := make([]byte, 16)
+	_, err := rand.Read(raw)
+	if err != nil {
+		return "", err
+	}
+	salt := make([]byte, len(raw))
+	for i, b := range raw {
+		salt[i] = CRYPT_ALPHABET[int(b)%len(CRYPT_ALPHABET)]
+	}
+	return sha512Crypt(password, string(salt), 0), nil
+}
+
+const (
+	CRYPT_DEFAULT_ROUNDS = 5000
+	CRYPT_MIN_ROUNDS     = 1000
+	CRYPT_MAX_ROUNDS     = 999999999
+)
+
+// sha512Crypt implements the $6$ scheme of glibc. Zero rounds selects the
+// default of 5000, which is left out of the result like glibc does. Other
+// values are clamped to the range glibc accepts.
+func sha512Crypt(password, salt string, rounds int) string {
+	p, s := []byte(password), []byte(salt)
+	if len(s) > 16 {
+		s = s[:16]
+	}
+	prefix := "$6$"
+	if rounds == 0 {
+		rounds = CRYPT_DEFAULT_ROUNDS
+	} else {
+		if rounds < CRYPT_MIN_ROUNDS {
+			rounds = CRYPT_MIN_ROUNDS
+		}
+		if rounds > CRYPT_MAX_ROUNDS {
+			rounds = CRYPT_MAX_ROUNDS
+		}
+		prefix += fmt.Sprintf("rounds=%d$", rounds)
+	}
+
+	b := sha512.New()
+	b.Write(p)
+	b.Write(s)
+	b.Write(p)
+	sumB := b.Sum(nil)
+
+	a := sha512.New()
+	a.Write(p)
+	a.Write(s)
+	for i := len(p); i > 0; i -= 64 {
+		if i > 64 {
+			a.Write(sumB)
+		} else {
+			a.Write(sumB[:i])
+		}
+	}
+	for i := len(p); i > 0; i >>= 1 {
+		if i&1 != 0 {
+			a.Write(sumB)
+		} else {
+			a.Write(p)
+		}
+	}
+	sumA := a.Sum(nil)
+
+	dp := sha512.New()
+	for range p {
+		dp.Write(p)
+	}
+	pBytes := repeatBytes(dp.Sum(nil), len(p))
+
+	ds := sha512.New()
+	for i := 0; i < 16+int(sumA[0]); i++ {
+		ds.Write(s)
+	}
+	sBytes := repeatBytes(ds.Sum(nil), len(s))
+
+	c := sumA
+	for round := 0; round < rounds; round++ {
+		h := sha512.New()
+		if round&1 != 0 {
+			h.Write(pBytes)
+		} else {
+			h.Write(c)
+		}
+		if round%3 != 0 {
+			h.Write(sBytes)
+		}
+		if round%7 != 0 {
+			h.Write(pBytes)
+		}
+		if round&1 != 0 {
+			h.Write(c)
+		} else {
+			h.Write(pBytes)
+		}
+		c = h.Sum(nil)
+	}
+
+	encoded := make([]byte, 0, 86)
+	encode := func(w uint, n int) {
+		for ; n > 0; n-- {
+			encoded = append(encoded, CRYPT_ALPHABET[w&0x3f])
+			w >>= 6
+		}
+	}
+	for i := 0; i < 21; i++ {
+		group := []byte{c[i], c[i+21], c[i+42]}
+		b0, b1, b2 := group[i%3], group[(i+1)%3], group[(i+2)%3]
+		encode(uint(b0)<<16|uint(b1)<<8|uint(b2), 4)
+	}
+	encode(uint(c[63]), 2)
+	return fmt.Sprintf("%s%s$%s", prefix, s, encoded)
+}
+
+func repeatBytes(sum []byte, length int) []byte {
+	result := make([]byte, 0, length)
+	for len(result) < length {
+		n := length - len(result)
+		if n > len(sum) {
+			n = len(sum)
+		}
+		result = append(result, sum[:n]...)
+	}
+	return result
+}
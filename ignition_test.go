@@ -0,0 +1,69 @@
+package main
+
+import (
+	"encoding/json"
+	"strings"
+	"testing"
+)
+
+// the test vectors of the SHA-crypt specification, which glibc ships
+func TestSHA512Crypt(t *testing.T) {
+	cases := []struct {
+		password string
+		salt     string
+		rounds   int
+		expected string
+	}{
+		{"Hello world!", "saltstring", 0,
+			"$6$saltstring$svn8UoSVapNtMuq1ukKS4tPQd8iKwSMHWjl/O817G3uBnIFNjnQJuesI68u4OTLiBFdcbYEdFCoEOfaS35inz1"},
+		{"Hello world!", "saltstringsaltstring", 10000,
+			"$6$rounds=10000$saltstringsaltst$OW1/O6BYHV6BcXZu8QVeXbDWra3Oeqh0sbHbbMCVNSnCM/UrjmM0Dp8vOuZeHBy/YTBmSK6H9qs/y3RnOaw5v."},
+		{"This is just a test", "toolongsaltstring", 5000,
+			"$6$rounds=5000$toolongsaltstrin$lQ8jolhgVRVhY4b5pZKaysCLi0QBxGoNeKQzQ3glMhwllF7oGDZxUhx1yxdYcz/e1JSbq3y6JMxxl8audkUEm0"},
+		{"a very much longer text to encrypt.  This one even stretches over morethan one line.", "anotherlongsaltstring", 1400,
+			"$6$rounds=1400$anotherlongsalts$POfYwTEok97VWcjxIiSOjiykti.o/pQs.wPvMxQ6Fm7I6IoYN3CmLs66x9t0oSwbtEW7o7UmJEiDwGqd8p4ur1"},
+		{"we have a short salt string but not a short password", "short", 77777,
+			"$6$rounds=77777$short$WuQyW2YR.hBNpjjRhpYD/ifIw05xdfeEyQoMxIXbkvr0gge1a1x3yRULJ5CCaUeOxFmtlcGZelFl5CxtgfiAc0"},
+		{"a short string", "asaltof16chars..", 123456,
+			"$6$rounds=123456$asaltof16chars..$BtCwjqMJGx5hrJhZywWvt0RLE8uZ4oPwcelCjmw2kSYu.Ec6ycULevoBK25fs2xXgMNrCzIMVcgEJAstJeonj1"},
+		{"the minimum number is still observed", "roundstoolow", 10,
+			"$6$rounds=1000$roundstoolow$kUMsbe306n21p9R.FRkW3IGn.S9NPN0x50YhH1xhLsPuWGsUSklZt58jaTfF4ZEQpyUNGc0dqbpBYYBaHHrsX."},
+	}
+	for _, c := range cases {
+		if actual := sha512Crypt(c.password, c.salt, c.rounds); actual != c.expected {
+			t.Errorf("%q with salt %s and %d rounds: got %s, expected %s", c.password, c.salt, c.rounds, actual, c.expected)
+		}
+	}
+}
+
+func TestHashPassword(t *testing.T) {
+	hash, err := hashPassword("secret")
+	if err != nil {
+		t.Fatal(err)
+	}
+	parts := strings.Split(hash, "$")
+	if len(parts) != 4 || parts[1] != "6" || len(parts[2]) != 16 {
+		t.Fatalf("unexpected hash %s", hash)
+	}
+	if sha512Crypt("secret", parts[2], 0) != hash {
+		t.Errorf("%s does not verify", hash)
+	}
+}
+
+func TestRenderIgnition(t *testing.T) {
+	raw, err := renderIgnition("core", "atomic1", []string{"ssh-ed25519 AAAA key"}, "secret", false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	conf := &ignitionConfig{}
+	err = json.Unmarshal(raw, conf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if conf.Ignition.Version != IGNITION_VERSION || len(conf.Passwd.Users) != 1 || conf.Passwd.Users[0].Name != "core" {
+		t.Errorf("unexpected config %s", raw)
+	}
+	if len(conf.Storage.Files) != 1 || conf.Storage.Files[0].Contents.Source != "data:,atomic1%0A" {
+		t.Errorf("unexpected files in %s", raw)
+	}
+}
@@ -0,0 +1,336 @@
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"text/tabwriter"
+
+	libvirt "github.com/libvirt/libvirt-go"
+	"github.com/urfave/cli"
+)
+
+func listImagesCommand(c *cli.Context) error {
+	workDir := getProjectDir(c)
+	sources, err := imageSources(workDir, c.String("image"))
+	if err != nil {
+		return err
+	}
+
+	w := tabwriter.NewWriter(os.Stdout, 0, 8, 2, ' ', 0)
+	fmt.Fprintln(w, "IMAGE\tARCH\tSIZE\tSHA256\tPRESENT\tUSED BY")
+	for _, src := range sources {
+		entries, err := readIndex(workDir, src)
+		if err != nil {
+			return err
+		}
+		for _, entry := range entries {
+			size := "-"
+			present := "no"
+			if info, err := os.Stat(entry.path(workDir)); err == nil {
+				size = formatBytes(uint64(info.Size()))
+				present = "yes"
+			} else if _, err := os.Stat(entry.downloadPath(workDir) + ".part"); err == nil {
+				present = "partial"
+			}
+			nodes, err := nodesUsingImage(workDir, entry)
+			if err != nil {
+				return err
+			}
+			usedBy := strings.Join(nodes, ",")
+			if usedBy == "" {
+				usedBy = "-"
+			}
+			fmt.Fprintf(w, "%s\t%s\t%s\t%s\t%s\t%s\n", entry.ref(), entry.arch, size, truncate(entry.shaSum, 12), present, usedBy)
+		}
+	}
+	return w.Flush()
+}
+
+func pullImagesCommand(c *cli.Context) error {
+	if !c.Args().Present() {
+		return fmt.Errorf("no image given. Usage: node-manager image pull <source>[:<version>]...")
+	}
+	workDir := getProjectDir(c)
+	conf, err := readConfig(workDir)
+	if err != nil {
+		return err
+	}
+	downloads := make([]*IndexEntry, 0)
+	for _, arg := range c.Args() {
+		ref, err := parseImageRef(arg)
+		if err != nil {
+			return err
+		}
+		ref = ref.withDefaultVersion(conf)
+		src, err := lookupImageSourceWithFlags(c, workDir, ref.source)
+		if err != nil {
+			return err
+		}
+		entries, err := resolveDownloads(workDir, src, []string{ref.version}, c.Bool("force"), c.Bool("refresh"), c.Bool("insecure"))
+		if err != nil {
+			return err
+		}
+		for _, entry := range entries {
+			if !entryInSlice(entry, downloads) {
+				downloads = append(downloads, entry)
+			}
+		}
+	}
+	if len(downloads) == 0 {
+		return nil
+	}
+	return downloadEntries(workDir, downloads, c.Int("jobs"))
+}
+
+// importImageCommand adds an image from local media. The image is looked up
+// in the index of its source by its checksum and verified like a download.
+func importImageCommand(c *cli.Context) error {
+	if c.NArg() != 1 {
+		return fmt.Errorf("expected exactly one image file. Usage: node-manager image import <file> [--sha256 <checksum>]")
+	}
+	file := c.Args().First()
+	workDir := getProjectDir(c)
+	ref, err := parseImageRef(c.String("image"))
+	if err != nil {
+		return err
+	}
+	src, err := lookupImageSourceWithFlags(c, workDir, ref.source)
+	if err != nil {
+		return err
+	}
+	entries, err := ensureIndex(workDir, src, c.String("index-file") != "", c.Bool("insecure"))
+	if err != nil {
+		return err
+	}
+
+	compression, err := detectCompression(file)
+	if err != nil {
+		return err
+	}
+	candidates, err := importCandidates(entries, ref.version, compression)
+	if err != nil {
+		return fmt.Errorf("can not import %s: %s", file, err)
+	}
+
+	shaSum := strings.ToLower(c.String("sha256"))
+	if shaSum == "" {
+		fmt.Printf("computing the checksum of %s\n", file)
+		shaSum, err = fileSha256(file)
+		if err != nil {
+			return err
+		}
+	}
+	var entry *IndexEntry
+	for _, e := range candidates {
+		if e.shaSum == shaSum {
+			entry = e
+		}
+	}
+	if entry == nil {
+		return fmt.Errorf("the index of %s contains no image with sha256 %s. Pass the matching index with --index-file", src.name(), shaSum)
+	}
+	if entry.isPresent && !c.Bool("force") {
+		fmt.Printf("%s is already present\n", entry)
+		return nil
+	}
+	if entry.isPresent {
+		nodes, err := nodesUsingImage(workDir, entry)
+		if err != nil {
+			return err
+		}
+		if len(nodes) > 0 {
+			return fmt.Errorf("can not replace %s, it is used by %s", entry, strings.Join(nodes, ", "))
+		}
+	}
+
+	entry.url, err = fileURL(file)
+	if err != nil {
+		return err
+	}
+	fmt.Printf("importing %s as %s\n", file, entry)
+	return entry.Download(workDir, newProgressWriter())
+}
+
+// importCandidates returns the entries of version, or of all versions if it
+// is empty, that an image file with compression can be imported as. The
+// index only has checksums of the files as downloaded, so a file unpacked
+// by hand can not be verified and is rejected with the file to import
+// instead.
+func importCandidates(entries []*IndexEntry, version, compression string) ([]*IndexEntry, error) {
+	candidates := make([]*IndexEntry, 0)
+	var expected *IndexEntry
+	for _, e := range entries {
+		if version != "" && e.version != version {
+			continue
+		}
+		if e.compression == compression {
+			candidates = append(candidates, e)
+		} else {
+			expected = e
+		}
+	}
+	if len(candidates) > 0 {
+		return candidates, nil
+	}
+	if expected == nil {
+		return nil, fmt.Errorf("the index contains no image of version %s", version)
+	}
+	actual := "is not compressed"
+	if compression != "" {
+		actual = "is compressed with " + compression
+	}
+	return nil, fmt.Errorf("the file %s, but the index only has checksums of downloads like %s. Import that file as downloaded", actual, expected.fileName)
+}
+
+func removeImagesCommand(c *cli.Context) error {
+	if !c.Args().Present() {
+		return fmt.Errorf("no image given. Usage: node-manager image rm <source>:<version>...")
+	}
+	workDir := getProjectDir(c)
+	entries := make([]*IndexEntry, 0)
+	for _, arg := range c.Args() {
+		ref, err := parseImageRef(arg)
+		if err != nil {
+			return err
+		}
+		if ref.version == "" {
+			return fmt.Errorf("image %s has no version. Use <source>:<version>", arg)
+		}
+		src, err := lookupImageSource(workDir, ref.source)
+		if err != nil {
+			return err
+		}
+		index, err := readIndex(workDir, src)
+		if err != nil {
+			return err
+		}
+		entry, err := selectIndexEntry(index, ref.version)
+		if err != nil {
+			return err
+		}
+		if !entry.isPresent {
+			return fmt.Errorf("%s is not present", entry)
+		}
+		nodes, err := nodesUsingImage(workDir, entry)
+		if err != nil {
+			return err
+		}
+		if len(nodes) > 0 {
+			return fmt.Errorf("can not remove %s, it is used by %s", entry, strings.Join(nodes, ", "))
+		}
+		entries = append(entries, entry)
+	}
+
+	for _, entry := range entries {
+		err := removeImage(c, workDir, entry)
+		if err != nil {
+			return err
+		}
+		fmt.Printf("removed %s\n", entry)
+	}
+	return nil
+}
+
+func pruneImagesCommand(c *cli.Context) error {
+	workDir := getProjectDir(c)
+	sources, err := imageSources(workDir, "")
+	if err != nil {
+		return err
+	}
+	dryRun := c.Bool("dry-run")
+	for _, src := range sources {
+		entries, err := readIndex(workDir, src)
+		if err != nil {
+			return err
+		}
+		for _, entry := range entries {
+			if !entry.isPresent {
+				continue
+			}
+			nodes, err := nodesUsingImage(workDir, entry)
+			if err != nil {
+				return err
+			}
+			if len(nodes) > 0 {
+				continue
+			}
+			if dryRun {
+				fmt.Printf("would remove %s\n", entry)
+				continue
+			}
+			err = removeImage(c, workDir, entry)
+			if err != nil {
+				return err
+			}
+			fmt.Printf("removed %s\n", entry)
+		}
+	}
+	return nil
+}
+
+// removeImage deletes the downloaded files of entry and its volume in the
+// storage pool.
+func removeImage(c *cli.Context, workDir string, entry *IndexEntry) error {
+	conn, err := connect(c)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+	pool, err := conn.LookupStoragePoolByName(c.GlobalString("pool"))
+	if err == nil {
+		vol, err := pool.LookupStorageVolByName(baseVolumeName(workDir, entry))
+		if err == nil {
+			err = vol.Delete(0)
+			vol.Free()
+		}
+		pool.Free()
+		if lverr, ok := err.(libvirt.Error); ok && lverr.Code == libvirt.ERR_NO_STORAGE_VOL {
+			err = nil
+		}
+		if err != nil {
+			return err
+		}
+	}
+
+	paths := []string{entry.path(workDir), entry.downloadPath(workDir), entry.downloadPath(workDir) + ".part"}
+	for _, path := range paths {
+		err = os.Remove(path)
+		if err != nil && !os.IsNotExist(err) {
+			return err
+		}
+	}
+	return nil
+}
+
+// imageSources returns the source called name or, if name is empty, all
+// sources with a downloaded index.
+func imageSources(workDir, name string) ([]imageSource, error) {
+	names := []string{name}
+	if name == "" {
+		dirs, err := ioutil.ReadDir(filepath.Join(workDir, "base"))
+		if err != nil && !os.IsNotExist(err) {
+			return nil, err
+		}
+		names = make([]string, 0)
+		for _, dir := range dirs {
+			if _, err := os.Stat(filepath.Join(workDir, "base", dir.Name(), "index")); err == nil {
+				names = append(names, dir.Name())
+			}
+		}
+		sort.Strings(names)
+	}
+
+	sources := make([]imageSource, 0, len(names))
+	for _, name := range names {
+		src, err := lookupImageSource(workDir, name)
+		if err != nil {
+			return nil, err
+		}
+		sources = append(sources, src)
+	}
+	return sources, nil
+}
@@ -0,0 +1,179 @@
+package main
+
+import (
+	"bytes"
+	"compress/gzip"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func testImportIndex() []*IndexEntry {
+	return []*IndexEntry{
+		{source: "centos-atomic", version: "1802", compression: "gz", shaSum: "aaaa", fileName: "CentOS-Atomic-Host-7.1802-GenericCloud.qcow2.gz"},
+		{source: "centos-atomic", version: "1803", compression: "gz", shaSum: "bbbb", fileName: "CentOS-Atomic-Host-7.1803-GenericCloud.qcow2.gz"},
+	}
+}
+
+// writeImportFiles writes an empty qcow2 image as is and gzipped.
+func writeImportFiles(t *testing.T, dir string) (string, string) {
+	image, err := qcow2Overlay("/pool/base.qcow2", "qcow2", 10<<30)
+	if err != nil {
+		t.Fatal(err)
+	}
+	compressed := &bytes.Buffer{}
+	w := gzip.NewWriter(compressed)
+	w.Write(image)
+	w.Close()
+
+	plainPath := filepath.Join(dir, "image.qcow2")
+	gzPath := filepath.Join(dir, "image.qcow2.gz")
+	err = ioutil.WriteFile(plainPath, image, 0644)
+	if err == nil {
+		err = ioutil.WriteFile(gzPath, compressed.Bytes(), 0644)
+	}
+	if err != nil {
+		t.Fatal(err)
+	}
+	return plainPath, gzPath
+}
+
+func TestImportCandidates(t *testing.T) {
+	dir, err := ioutil.TempDir("", "node-manager")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	plainPath, gzPath := writeImportFiles(t, dir)
+
+	cases := []struct {
+		file     string
+		version  string
+		expected []string
+		message  string
+	}{
+		{gzPath, "", []string{"1802", "1803"}, ""},
+		{gzPath, "1803", []string{"1803"}, ""},
+		{gzPath, "1901", nil, "no image of version 1901"},
+		{plainPath, "", nil, "is not compressed"},
+		{plainPath, "1802", nil, "CentOS-Atomic-Host-7.1802-GenericCloud.qcow2.gz"},
+	}
+	for _, c := range cases {
+		compression, err := detectCompression(c.file)
+		if err != nil {
+			t.Fatal(err)
+		}
+		candidates, err := importCandidates(testImportIndex(), c.version, compression)
+		if c.message != "" {
+			if err == nil || !strings.Contains(err.Error(), c.message) {
+				t.Errorf("%s of %q: got %v, expected an error about %s", filepath.Base(c.file), c.version, err, c.message)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("%s of %q: %s", filepath.Base(c.file), c.version, err)
+			continue
+		}
+		versions := make([]string, len(candidates))
+		for i, entry := range candidates {
+			versions[i] = entry.version
+		}
+		if strings.Join(versions, ",") != strings.Join(c.expected, ",") {
+			t.Errorf("%s of %q: got versions %q, expected %q", filepath.Base(c.file), c.version, versions, c.expected)
+		}
+	}
+}
+
+func TestImportCandidatesOfUncompressedIndex(t *testing.T) {
+	entries := []*IndexEntry{{source: "fedora-coreos", version: "31", shaSum: "cccc", fileName: "fedora-coreos-31-qemu.x86_64.qcow2"}}
+	candidates, err := importCandidates(entries, "", "")
+	if err != nil || len(candidates) != 1 {
+		t.Errorf("got %v, %v", candidates, err)
+	}
+	_, err = importCandidates(entries, "", "xz")
+	if err == nil || !strings.Contains(err.Error(), "compressed with xz") {
+		t.Errorf("an xz file was accepted for an uncompressed index: %v", err)
+	}
+}
+
+func TestDetectCompression(t *testing.T) {
+	dir, err := ioutil.TempDir("", "node-manager")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	plainPath, gzPath := writeImportFiles(t, dir)
+	files := map[string][]byte{
+		"image.qcow2.bz2": []byte("BZh91AY&SY"),
+		"image.qcow2.xz":  {0xfd, '7', 'z', 'X', 'Z', 0, 0, 4},
+		"empty":           nil,
+	}
+	for name, content := range files {
+		err = ioutil.WriteFile(filepath.Join(dir, name), content, 0644)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	expected := map[string]string{
+		plainPath:                             "",
+		gzPath:                                "gz",
+		filepath.Join(dir, "image.qcow2.bz2"): "bz2",
+		filepath.Join(dir, "image.qcow2.xz"):  "xz",
+		filepath.Join(dir, "empty"):           "",
+	}
+	for path, compression := range expected {
+		actual, err := detectCompression(path)
+		if err != nil || actual != compression {
+			t.Errorf("%s: got %q, %v, expected %q", filepath.Base(path), actual, err, compression)
+		}
+	}
+}
+
+func TestImportCompressedImage(t *testing.T) {
+	dir, err := ioutil.TempDir("", "node-manager")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	plainPath, gzPath := writeImportFiles(t, dir)
+	shaSum, err := fileSha256(gzPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	entries := testImportIndex()
+	entries[1].shaSum = shaSum
+
+	candidates, err := importCandidates(entries, "1803", "gz")
+	if err != nil || len(candidates) != 1 || candidates[0].shaSum != shaSum {
+		t.Fatalf("got %v, %v", candidates, err)
+	}
+	entry := candidates[0]
+	entry.url, err = fileURL(gzPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// init creates the image directories of a source
+	workDir := filepath.Join(dir, "work")
+	err = os.MkdirAll(filepath.Join(sourceDir(workDir, entry.source), "images"), os.ModePerm)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = entry.Download(workDir, newProgressWriter())
+	if err != nil {
+		t.Fatal(err)
+	}
+	imported, err := ioutil.ReadFile(entry.path(workDir))
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected, err := ioutil.ReadFile(plainPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(imported, expected) {
+		t.Errorf("the imported image differs from the unpacked one")
+	}
+}
@@ -0,0 +1,414 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/url"
+	"path"
+	"path/filepath"
+	"regexp"
+	"runtime"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+const DEFAULT_IMAGE_SOURCE = "centos-atomic"
+
+// imageSource describes where the index of base images of a distribution
+// lives and how to read it.
+type imageSource interface {
+	name() string
+	indexURL() string
+	parseIndex(r io.Reader) ([]*IndexEntry, error)
+	defaultUser() string
+	// signatureURL locates the OpenPGP signature of the index. It is empty
+	// for sources that do not sign their index.
+	signatureURL() string
+	// usesIgnition tells whether the images are provisioned with an
+	// Ignition config instead of a cloud-init seed.
+	usesIgnition() bool
+}
+
+type imageRef struct {
+	source  string
+	version string
+}
+
+func (r imageRef) String() string {
+	if r.version == "" {
+		return r.source
+	}
+	return r.source + ":" + r.version
+}
+
+// parseImageRef parses references of the form <source>[:<version>]. An
+// empty version selects the newest image of the source.
+func parseImageRef(raw string) (imageRef, error) {
+	if raw == "" {
+		return imageRef{source: DEFAULT_IMAGE_SOURCE}, nil
+	}
+	parts := strings.SplitN(raw, ":", 2)
+	ref := imageRef{source: parts[0]}
+	if len(parts) == 2 {
+		ref.version = parts[1]
+	}
+	if ref.source == "" {
+		return ref, fmt.Errorf("invalid image %s. Expected <source>[:<version>]", raw)
+	}
+	return ref, nil
+}
+
+// withDefaultVersion fills in the version pinned in config.yaml if the
+// reference has none.
+func (r imageRef) withDefaultVersion(conf *config) imageRef {
+	if r.version == "" {
+		r.version = conf.ImageVersions[r.source]
+	}
+	return r
+}
+
+func lookupImageSource(workDir, name string) (imageSource, error) {
+	conf, err := readConfig(workDir)
+	if err != nil {
+		return nil, err
+	}
+	src, err := builtinImageSource(conf, name)
+	if err != nil {
+		return nil, err
+	}
+	if mirror, ok := conf.Mirrors[name]; ok {
+		return newMirroredSource(src, "", mirror)
+	}
+	return src, nil
+}
+
+func builtinImageSource(conf *config, name string) (imageSource, error) {
+	for _, sc := range conf.ImageSources {
+		if sc.Name == name {
+			user := sc.User
+			if user == "" {
+				user = "root"
+			}
+			return newChecksumSource(sc.Name, sc.ChecksumURL, sc.SignatureURL, sc.BaseURL, sc.Pattern, sc.Arch, user)
+		}
+	}
+
+	switch {
+	case name == "centos-atomic":
+		return newChecksumSource(name,
+			"https://cloud.centos.org/centos/7/atomic/images/sha256sum.txt",
+			"https://cloud.centos.org/centos/7/atomic/images/sha256sum.txt.asc",
+			"https://cloud.centos.org/centos/7/atomic/images",
+			`^CentOS-Atomic-Host-7\.(?P<version>\d{4})-GenericCloud\.qcow2\.(?P<compression>gz)$`,
+			"x86_64",
+			"centos",
+		)
+	case strings.HasPrefix(name, "ubuntu-"):
+		release := strings.TrimPrefix(name, "ubuntu-")
+		baseURL := fmt.Sprintf("https://cloud-images.ubuntu.com/releases/%s/release", release)
+		return newChecksumSource(name,
+			baseURL+"/SHA256SUMS",
+			baseURL+"/SHA256SUMS.gpg",
+			baseURL,
+			`^ubuntu-(?P<version>\d+\.\d+)-server-cloudimg-(?P<arch>amd64|arm64)\.img$`,
+			"",
+			"ubuntu",
+		)
+	case name == "fedora-coreos" || strings.HasPrefix(name, "fedora-coreos-"):
+		stream := strings.TrimPrefix(strings.TrimPrefix(name, "fedora-coreos"), "-")
+		if stream == "" {
+			stream = "stable"
+		}
+		return &coreosSource{sourceName: name, stream: stream}, nil
+	}
+	return nil, fmt.Errorf("unknown image source %s", name)
+}
+
+// mirroredSource serves the index and the images of a source from another
+// location, e.g. a directory on local media.
+type mirroredSource struct {
+	imageSource
+	index  string
+	mirror string
+}
+
+// newMirroredSource replaces the index of src with the file or URL index and
+// fetches the index and the images from the directory or URL mirror instead.
+// Empty values keep the original location.
+func newMirroredSource(src imageSource, index, mirror string) (imageSource, error) {
+	index, err := fileURL(index)
+	if err != nil {
+		return nil, err
+	}
+	mirror, err = fileURL(mirror)
+	if err != nil {
+		return nil, err
+	}
+	return &mirroredSource{src, index, strings.TrimSuffix(mirror, "/")}, nil
+}
+
+func (s *mirroredSource) indexURL() string {
+	if s.index != "" {
+		return s.index
+	}
+	if s.mirror != "" {
+		return s.mirror + "/" + path.Base(s.imageSource.indexURL())
+	}
+	return s.imageSource.indexURL()
+}
+
+// signatureURL expects the signature next to a replaced index or in the
+// mirror.
+func (s *mirroredSource) signatureURL() string {
+	original := s.imageSource.signatureURL()
+	switch {
+	case original == "":
+		return ""
+	case s.index != "":
+		return siblingURL(s.index, path.Base(original))
+	case s.mirror != "":
+		return s.mirror + "/" + path.Base(original)
+	}
+	return original
+}
+
+// siblingURL locates the file called name in the directory of location.
+func siblingURL(location, name string) string {
+	base, err := url.Parse(location)
+	if err != nil {
+		return location
+	}
+	return base.ResolveReference(&url.URL{Path: name}).String()
+}
+
+func (s *mirroredSource) parseIndex(r io.Reader) ([]*IndexEntry, error) {
+	entries, err := s.imageSource.parseIndex(r)
+	if err != nil || s.mirror == "" {
+		return entries, err
+	}
+	for _, entry := range entries {
+		entry.url = s.mirror + "/" + path.Base(entry.url)
+	}
+	return entries, nil
+}
+
+// fileURL turns local paths into file:// URLs. URLs are returned as they
+// are.
+func fileURL(location string) (string, error) {
+	if location == "" || strings.Contains(location, "://") {
+		return location, nil
+	}
+	abs, err := filepath.Abs(location)
+	if err != nil {
+		return "", err
+	}
+	return (&url.URL{Scheme: "file", Path: abs}).String(), nil
+}
+
+// checksumSource reads a sha256sum style checksum file, which may be signed
+// by a detached or clearsigned signature. The base images are expected next
+// to it in baseURL. pattern selects the relevant files and
+// extracts the version, and optionally the arch and the compression, through
+// named groups.
+type checksumSource struct {
+	sourceName  string
+	checksumURL string
+	signature   string
+	baseURL     string
+	pattern     *regexp.Regexp
+	arch        string
+	user        string
+}
+
+func newChecksumSource(name, checksumURL, signatureURL, baseURL, pattern, arch, user string) (*checksumSource, error) {
+	if checksumURL == "" || baseURL == "" {
+		return nil, fmt.Errorf("image source %s needs a checksum and a base url", name)
+	}
+	re, err := regexp.Compile(pattern)
+	if err != nil {
+		return nil, fmt.Errorf("image source %s has an invalid pattern: %s", name, err)
+	}
+	hasVersion := false
+	for _, group := range re.SubexpNames() {
+		hasVersion = hasVersion || group == "version"
+	}
+	if !hasVersion {
+		return nil, fmt.Errorf("the pattern of image source %s needs a named group 'version'", name)
+	}
+	return &checksumSource{name, checksumURL, signatureURL, strings.TrimSuffix(baseURL, "/"), re, arch, user}, nil
+}
+
+func (s *checksumSource) name() string {
+	return s.sourceName
+}
+
+func (s *checksumSource) indexURL() string {
+	return s.checksumURL
+}
+
+func (s *checksumSource) signatureURL() string {
+	return s.signature
+}
+
+func (s *checksumSource) defaultUser() string {
+	return s.user
+}
+
+func (s *checksumSource) usesIgnition() bool {
+	return false
+}
+
+func (s *checksumSource) parseIndex(r io.Reader) ([]*IndexEntry, error) {
+	result := make([]*IndexEntry, 0)
+	scanner := bufio.NewScanner(r)
+	for scanner.Scan() {
+		fields := strings.Fields(scanner.Text())
+		if len(fields) != 2 {
+			continue
+		}
+		checksum := fields[0]
+		file := strings.TrimPrefix(fields[1], "*")
+		match := s.pattern.FindStringSubmatch(file)
+		if match == nil {
+			continue
+		}
+		entry := &IndexEntry{
+			source:   s.sourceName,
+			arch:     s.arch,
+			shaSum:   checksum,
+			fileName: file,
+			url:      fmt.Sprintf("%s/%s", s.baseURL, file),
+		}
+		for i, group := range s.pattern.SubexpNames() {
+			switch group {
+			case "version":
+				entry.version = match[i]
+			case "arch":
+				entry.arch = match[i]
+			case "compression":
+				entry.compression = match[i]
+			}
+		}
+		result = append(result, entry)
+	}
+	return result, scanner.Err()
+}
+
+// coreosSource reads the stream metadata of Fedora CoreOS. A stream only
+// references the current release for each architecture.
+type coreosSource struct {
+	sourceName string
+	stream     string
+}
+
+type coreosStream struct {
+	Architectures map[string]struct {
+		Artifacts map[string]struct {
+			Release string `json:"release"`
+			Formats map[string]struct {
+				Disk struct {
+					Location string `json:"location"`
+					Sha256   string `json:"sha256"`
+				} `json:"disk"`
+			} `json:"formats"`
+		} `json:"artifacts"`
+	} `json:"architectures"`
+}
+
+func (s *coreosSource) name() string {
+	return s.sourceName
+}
+
+func (s *coreosSource) indexURL() string {
+	return fmt.Sprintf("https://builds.coreos.fedoraproject.org/streams/%s.json", s.stream)
+}
+
+func (s *coreosSource) signatureURL() string {
+	return ""
+}
+
+func (s *coreosSource) defaultUser() string {
+	return "core"
+}
+
+func (s *coreosSource) usesIgnition() bool {
+	return true
+}
+
+// httpsOrigin trusts the stream metadata for coming from
+// builds.coreos.fedoraproject.org, as Fedora does not sign it. The images
+// are checked against its sha256 checksums.
+func (s *coreosSource) httpsOrigin() bool {
+	return true
+}
+
+func (s *coreosSource) parseIndex(r io.Reader) ([]*IndexEntry, error) {
+	stream := &coreosStream{}
+	err := json.NewDecoder(r).Decode(stream)
+	if err != nil {
+		return nil, err
+	}
+	result := make([]*IndexEntry, 0)
+	for arch, content := range stream.Architectures {
+		qemu, ok := content.Artifacts["qemu"]
+		if !ok {
+			continue
+		}
+		for format, artifact := range qemu.Formats {
+			if !strings.HasPrefix(format, "qcow2") {
+				continue
+			}
+			result = append(result, &IndexEntry{
+				source:      s.sourceName,
+				version:     qemu.Release,
+				arch:        arch,
+				compression: strings.TrimPrefix(strings.TrimPrefix(format, "qcow2"), "."),
+				shaSum:      artifact.Disk.Sha256,
+				fileName:    path.Base(artifact.Disk.Location),
+				url:         artifact.Disk.Location,
+			})
+		}
+	}
+	return result, nil
+}
+
+func hostArchitectures() []string {
+	switch runtime.GOARCH {
+	case "amd64":
+		return []string{"x86_64", "amd64"}
+	case "arm64":
+		return []string{"aarch64", "arm64"}
+	}
+	return []string{runtime.GOARCH}
+}
+
+func sortIndexEntries(entries []*IndexEntry) {
+	sort.SliceStable(entries, func(i, j int) bool {
+		return compareVersions(entries[i].version, entries[j].version) < 0
+	})
+}
+
+// compareVersions compares dotted or dashed version strings segment by
+// segment, numerically where both segments are numbers.
+func compareVersions(a, b string) int {
+	split := func(r rune) bool { return r == '.' || r == '-' }
+	as := strings.FieldsFunc(a, split)
+	bs := strings.FieldsFunc(b, split)
+	for i := 0; i < len(as) && i < len(bs); i++ {
+		an, aErr := strconv.Atoi(as[i])
+		bn, bErr := strconv.Atoi(bs[i])
+		switch {
+		case aErr == nil && bErr == nil && an != bn:
+			if an < bn {
+				return -1
+			}
+			return 1
+		case (aErr != nil || bErr != nil) && as[i] != bs[i]:
+			return strings.Compare(as[i], bs[i])
+		}
+	}
+	return len(as) - len(bs)
+}
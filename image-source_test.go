@@ -0,0 +1,37 @@
+package main
+
+import "testing"
+
+func TestMirroredSignatureURL(t *testing.T) {
+	centos, err := newChecksumSource("centos-atomic",
+		"https://cloud.centos.org/centos/7/atomic/images/sha256sum.txt",
+		"https://cloud.centos.org/centos/7/atomic/images/sha256sum.txt.asc",
+		"https://cloud.centos.org/centos/7/atomic/images",
+		`^CentOS-Atomic-Host-7\.(?P<version>\d{4})-GenericCloud\.qcow2$`, "x86_64", "centos")
+	if err != nil {
+		t.Fatal(err)
+	}
+	cases := []struct {
+		src      imageSource
+		index    string
+		mirror   string
+		expected string
+	}{
+		{centos, "", "", "https://cloud.centos.org/centos/7/atomic/images/sha256sum.txt.asc"},
+		{centos, "", "https://mirror.example.com/centos/", "https://mirror.example.com/centos/sha256sum.txt.asc"},
+		{centos, "https://mirror.example.com/centos/sha256sum.txt", "", "https://mirror.example.com/centos/sha256sum.txt.asc"},
+		{centos, "https://mirror.example.com/centos/sha256sum.txt", "https://images.example.com/", "https://mirror.example.com/centos/sha256sum.txt.asc"},
+		{centos, "/srv/images/sha256sum.txt", "", "file:///srv/images/sha256sum.txt.asc"},
+		{centos, "", "/srv/images", "file:///srv/images/sha256sum.txt.asc"},
+		{&coreosSource{sourceName: "fedora-coreos", stream: "stable"}, "https://mirror.example.com/stable.json", "", ""},
+	}
+	for _, c := range cases {
+		src, err := newMirroredSource(c.src, c.index, c.mirror)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if actual := src.signatureURL(); actual != c.expected {
+			t.Errorf("index %q and mirror %q: got %s, expected %s", c.index, c.mirror, actual, c.expected)
+		}
+	}
+}
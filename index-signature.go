@@ -0,0 +1,238 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"golang.org/x/crypto/openpgp"
+	"golang.org/x/crypto/openpgp/armor"
+	"golang.org/x/crypto/openpgp/clearsign"
+)
+
+// httpsOriginSource is implemented by sources that do not sign their index
+// but only publish it over https. The index, and through its checksums the
+// images, are trusted for coming from that origin.
+type httpsOriginSource interface {
+	httpsOrigin() bool
+}
+
+// fetchVerifiedIndex downloads the index of src and checks its signature
+// against the keyring. Unless insecure is set, indexes have to be signed
+// and are only fetched over https or from local files. The index of an
+// httpsOriginSource only has to come from its https origin.
+func fetchVerifiedIndex(src imageSource, workDir string, insecure bool) ([]byte, error) {
+	if insecure {
+		fmt.Printf("not verifying the index of %s\n", src.name())
+		return fetch(src.indexURL())
+	}
+
+	signatureURL := src.signatureURL()
+	if origin, ok := src.(httpsOriginSource); ok && signatureURL == "" && origin.httpsOrigin() {
+		if !strings.HasPrefix(src.indexURL(), "https://") {
+			return nil, fmt.Errorf("the index of %s is not signed and only trusted from https. Pass --insecure to use %s anyway", src.name(), src.indexURL())
+		}
+		return fetch(src.indexURL())
+	}
+	if signatureURL == "" {
+		return nil, fmt.Errorf("the index of %s is not signed. Pass --insecure to use it anyway. Unsigned sources are only trusted from their original https location, not from mirrors", src.name())
+	}
+	for _, location := range []string{src.indexURL(), signatureURL} {
+		err := checkSecureURL(location)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	keyring, err := sourceKeyring(workDir, src.name())
+	if err != nil {
+		return nil, err
+	}
+	signature, err := fetch(signatureURL)
+	if err != nil {
+		return nil, err
+	}
+
+	// a clearsigned signature carries the index itself
+	if block, _ := clearsign.Decode(signature); block != nil {
+		_, err = openpgp.CheckDetachedSignature(keyring, bytes.NewReader(block.Bytes), block.ArmoredSignature.Body)
+		if err != nil {
+			return nil, fmt.Errorf("invalid signature of the index of %s: %s", src.name(), err)
+		}
+		return block.Plaintext, nil
+	}
+
+	index, err := fetch(src.indexURL())
+	if err != nil {
+		return nil, err
+	}
+	if bytes.HasPrefix(bytes.TrimSpace(signature), []byte("-----BEGIN PGP SIGNATURE-----")) {
+		_, err = openpgp.CheckArmoredDetachedSignature(keyring, bytes.NewReader(index), bytes.NewReader(signature))
+	} else {
+		_, err = openpgp.CheckDetachedSignature(keyring, bytes.NewReader(index), bytes.NewReader(signature))
+	}
+	if err != nil {
+		return nil, fmt.Errorf("invalid signature of the index of %s: %s", src.name(), err)
+	}
+	return index, nil
+}
+
+func checkSecureURL(location string) error {
+	parsed, err := url.Parse(location)
+	if err != nil {
+		return err
+	}
+	if parsed.Scheme != "https" && parsed.Scheme != "file" {
+		return fmt.Errorf("refusing to fetch %s without https. Pass --insecure to do it anyway", location)
+	}
+	return nil
+}
+
+func fetch(location string) ([]byte, error) {
+	resp, err := httpClient.Get(location)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("could not download %s: %s", location, resp.Status)
+	}
+	return ioutil.ReadAll(resp.Body)
+}
+
+// signingKey is the key that a builtin image source signs its index with.
+// It is fetched when it is first needed and only trusted if its fingerprint
+// matches.
+type signingKey struct {
+	url         string
+	fingerprint string
+}
+
+var builtinSigningKeys = map[string]signingKey{
+	"centos-atomic": {
+		url:         "https://www.centos.org/keys/RPM-GPG-KEY-CentOS-7",
+		fingerprint: "6341AB2753D78A78A7C27BB124C6A8A7F4A80EB5",
+	},
+}
+
+// sourceKeyring collects the keys that may sign the index of source: the
+// configured keyring and the builtin key of the source. The keyring may be
+// missing for sources with a builtin key.
+func sourceKeyring(workDir, source string) (openpgp.EntityList, error) {
+	location, err := keyringLocation(workDir, source)
+	if err != nil {
+		return nil, err
+	}
+	key, builtin := builtinSigningKeys[source]
+	keyring := openpgp.EntityList{}
+	if _, err := os.Stat(location); err == nil || !builtin {
+		keyring, err = readKeyring(location)
+		if err != nil {
+			return nil, err
+		}
+	}
+	if !builtin {
+		return keyring, nil
+	}
+	entities, err := key.load(fmt.Sprintf("%s/signing-key.asc", sourceDir(workDir, source)))
+	if err != nil {
+		return nil, err
+	}
+	return append(keyring, entities...), nil
+}
+
+// load reads the key from path or fetches it into path if it is missing.
+func (k signingKey) load(path string) (openpgp.EntityList, error) {
+	content, err := ioutil.ReadFile(path)
+	if os.IsNotExist(err) {
+		fmt.Printf("fetching the signing key %s\n", k.fingerprint)
+		content, err = fetch(k.url)
+		if err != nil {
+			return nil, err
+		}
+		entities, err := k.verify(content)
+		if err != nil {
+			return nil, err
+		}
+		err = os.MkdirAll(filepath.Dir(path), os.ModePerm)
+		if err == nil {
+			err = ioutil.WriteFile(path, content, 0644)
+		}
+		return entities, err
+	}
+	if err != nil {
+		return nil, err
+	}
+	return k.verify(content)
+}
+
+// verify parses an armored key and checks its fingerprint.
+func (k signingKey) verify(content []byte) (openpgp.EntityList, error) {
+	entities, err := openpgp.ReadArmoredKeyRing(bytes.NewReader(content))
+	if err != nil {
+		return nil, fmt.Errorf("could not read the signing key from %s: %s", k.url, err)
+	}
+	for _, entity := range entities {
+		if fmt.Sprintf("%X", entity.PrimaryKey.Fingerprint[:]) == k.fingerprint {
+			return openpgp.EntityList{entity}, nil
+		}
+	}
+	return nil, fmt.Errorf("the key at %s does not have the fingerprint %s", k.url, k.fingerprint)
+}
+
+// keyringLocation returns the keyring configured for the image source, the
+// global one or keyring.gpg in the working directory.
+func keyringLocation(workDir, source string) (string, error) {
+	conf, err := readConfig(workDir)
+	if err != nil {
+		return "", err
+	}
+	for _, sc := range conf.ImageSources {
+		if sc.Name == source && sc.Keyring != "" {
+			return sc.Keyring, nil
+		}
+	}
+	if conf.Keyring != "" {
+		return conf.Keyring, nil
+	}
+	return fmt.Sprintf("%s/keyring.gpg", workDir), nil
+}
+
+// readKeyring reads binary keyrings as well as one or more ASCII armored
+// public key blocks.
+func readKeyring(location string) (openpgp.EntityList, error) {
+	content, err := ioutil.ReadFile(location)
+	if os.IsNotExist(err) {
+		return nil, fmt.Errorf("keyring %s not found. Add the signing keys of your image sources with gpg --export <key id> >> %s", location, location)
+	}
+	if err != nil {
+		return nil, err
+	}
+	if !bytes.HasPrefix(bytes.TrimSpace(content), []byte("-----BEGIN")) {
+		return openpgp.ReadKeyRing(bytes.NewReader(content))
+	}
+
+	keyring := make(openpgp.EntityList, 0)
+	reader := bytes.NewReader(content)
+	for {
+		block, err := armor.Decode(reader)
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, fmt.Errorf("could not read keyring %s: %s", location, err)
+		}
+		entities, err := openpgp.ReadKeyRing(block.Body)
+		if err != nil {
+			return nil, fmt.Errorf("could not read keyring %s: %s", location, err)
+		}
+		keyring = append(keyring, entities...)
+	}
+	return keyring, nil
+}
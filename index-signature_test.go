@@ -0,0 +1,287 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+
+	"golang.org/x/crypto/openpgp"
+	"golang.org/x/crypto/openpgp/armor"
+	"golang.org/x/crypto/openpgp/clearsign"
+)
+
+func armoredKey(t *testing.T, entity *openpgp.Entity) []byte {
+	buf := &bytes.Buffer{}
+	w, err := armor.Encode(buf, openpgp.PublicKeyType, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = entity.Serialize(w)
+	if err == nil {
+		err = w.Close()
+	}
+	if err != nil {
+		t.Fatal(err)
+	}
+	return buf.Bytes()
+}
+
+func TestSigningKeyFingerprint(t *testing.T) {
+	trusted, err := openpgp.NewEntity("trusted", "", "trusted@example.com", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	other, err := openpgp.NewEntity("other", "", "other@example.com", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	key := signingKey{url: "https://example.com/key", fingerprint: fmt.Sprintf("%X", trusted.PrimaryKey.Fingerprint[:])}
+
+	entities, err := key.verify(armoredKey(t, trusted))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(entities) != 1 || entities[0].PrimaryKey.KeyId != trusted.PrimaryKey.KeyId {
+		t.Errorf("expected the trusted key, got %d keys", len(entities))
+	}
+	_, err = key.verify(armoredKey(t, other))
+	if err == nil {
+		t.Error("a key with another fingerprint was accepted")
+	}
+}
+
+// testIndexSource serves an index from fixed locations.
+type testIndexSource struct {
+	index     string
+	signature string
+}
+
+func (s *testIndexSource) name() string                                  { return "test" }
+func (s *testIndexSource) indexURL() string                              { return s.index }
+func (s *testIndexSource) signatureURL() string                          { return s.signature }
+func (s *testIndexSource) parseIndex(r io.Reader) ([]*IndexEntry, error) { return nil, nil }
+func (s *testIndexSource) defaultUser() string                           { return "test" }
+func (s *testIndexSource) usesIgnition() bool                            { return false }
+
+// testOriginSource is trusted when its index comes from https.
+type testOriginSource struct {
+	testIndexSource
+}
+
+func (s *testOriginSource) httpsOrigin() bool {
+	return true
+}
+
+const testIndex = "abc123  Test-Image-1.qcow2.gz\n"
+
+// signedIndexFixtures signs testIndex in every supported way with signer.
+// The files are served under their names.
+func signedIndexFixtures(t *testing.T, signer *openpgp.Entity) map[string][]byte {
+	clearsigned := &bytes.Buffer{}
+	w, err := clearsign.Encode(clearsigned, signer.PrivateKey, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	io.WriteString(w, testIndex)
+	w.Close()
+	armored := &bytes.Buffer{}
+	err = openpgp.ArmoredDetachSign(armored, signer, strings.NewReader(testIndex), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	binary := &bytes.Buffer{}
+	err = openpgp.DetachSign(binary, signer, strings.NewReader(testIndex), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return map[string][]byte{
+		"SHA256SUMS":          []byte(testIndex),
+		"SHA256SUMS.tampered": []byte(strings.Replace(testIndex, "abc123", "def456", 1)),
+		"SHA256SUMS.asc":      clearsigned.Bytes(),
+		"SHA256SUMS.sig":      armored.Bytes(),
+		"SHA256SUMS.gpg":      binary.Bytes(),
+	}
+}
+
+// indexFixtures are the signed indexes of a trusted and of an untrusted
+// key, each in its own directory below dir. Only the trusted key is in the
+// keyring of workDir.
+type indexFixtures struct {
+	workDir   string
+	dir       string
+	serverURL string
+	fileURL   string
+	trusted   string
+	untrusted string
+}
+
+// newIndexFixtures writes the fixtures and serves them over https.
+func newIndexFixtures(t *testing.T) (*indexFixtures, func()) {
+	trusted, err := openpgp.NewEntity("trusted", "", "trusted@example.com", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	untrusted, err := openpgp.NewEntity("untrusted", "", "untrusted@example.com", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	workDir, err := ioutil.TempDir("", "node-manager")
+	if err != nil {
+		t.Fatal(err)
+	}
+	f := &indexFixtures{workDir: workDir, dir: filepath.Join(workDir, "mirror"), trusted: "trusted", untrusted: "untrusted"}
+	keyring := &bytes.Buffer{}
+	err = trusted.Serialize(keyring)
+	if err == nil {
+		err = ioutil.WriteFile(filepath.Join(workDir, "keyring.gpg"), keyring.Bytes(), 0644)
+	}
+	signers := map[string]*openpgp.Entity{f.trusted: trusted, f.untrusted: untrusted}
+	for name, signer := range signers {
+		signerDir := filepath.Join(f.dir, name)
+		if err == nil {
+			err = os.MkdirAll(signerDir, os.ModePerm)
+		}
+		for file, content := range signedIndexFixtures(t, signer) {
+			if err == nil {
+				err = ioutil.WriteFile(filepath.Join(signerDir, file), content, 0644)
+			}
+		}
+	}
+	if err == nil {
+		f.fileURL, err = fileURL(f.dir)
+	}
+	if err != nil {
+		os.RemoveAll(workDir)
+		t.Fatal(err)
+	}
+
+	server := httptest.NewTLSServer(http.FileServer(http.Dir(f.dir)))
+	f.serverURL = server.URL
+	client := httpClient
+	httpClient = newHTTPClient()
+	httpClient.Transport.(*http.Transport).TLSClientConfig = server.Client().Transport.(*http.Transport).TLSClientConfig
+	return f, func() {
+		httpClient = client
+		server.Close()
+		os.RemoveAll(workDir)
+	}
+}
+
+func TestFetchVerifiedIndex(t *testing.T) {
+	f, cleanup := newIndexFixtures(t)
+	defer cleanup()
+
+	cases := []struct {
+		name     string
+		base     string
+		signer   string
+		index    string
+		signed   string
+		insecure bool
+		message  string
+	}{
+		{"clearsigned", f.serverURL, f.trusted, "SHA256SUMS", "SHA256SUMS.asc", false, ""},
+		{"armored detached", f.serverURL, f.trusted, "SHA256SUMS", "SHA256SUMS.sig", false, ""},
+		{"binary detached", f.serverURL, f.trusted, "SHA256SUMS", "SHA256SUMS.gpg", false, ""},
+		{"local mirror", f.fileURL, f.trusted, "SHA256SUMS", "SHA256SUMS.sig", false, ""},
+		{"tampered armored", f.serverURL, f.trusted, "SHA256SUMS.tampered", "SHA256SUMS.sig", false, "invalid signature"},
+		{"tampered binary", f.fileURL, f.trusted, "SHA256SUMS.tampered", "SHA256SUMS.gpg", false, "invalid signature"},
+		{"untrusted clearsigned", f.serverURL, f.untrusted, "SHA256SUMS", "SHA256SUMS.asc", false, "invalid signature"},
+		{"untrusted detached", f.serverURL, f.untrusted, "SHA256SUMS", "SHA256SUMS.gpg", false, "invalid signature"},
+		{"untrusted but insecure", f.serverURL, f.untrusted, "SHA256SUMS", "SHA256SUMS.gpg", true, ""},
+		{"unsigned", f.serverURL, f.trusted, "SHA256SUMS", "", false, "is not signed"},
+		{"unsigned but insecure", f.serverURL, f.trusted, "SHA256SUMS", "", true, ""},
+	}
+	for _, c := range cases {
+		src := &testIndexSource{index: c.base + "/" + c.signer + "/" + c.index}
+		if c.signed != "" {
+			src.signature = c.base + "/" + c.signer + "/" + c.signed
+		}
+		index, err := fetchVerifiedIndex(src, f.workDir, c.insecure)
+		if c.message != "" {
+			if err == nil || !strings.Contains(err.Error(), c.message) {
+				t.Errorf("%s: got %v, expected an error about %s", c.name, err, c.message)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("%s: %s", c.name, err)
+		} else if string(index) != testIndex {
+			t.Errorf("%s: got index %q", c.name, index)
+		}
+	}
+}
+
+func TestFetchVerifiedIndexRefusesHTTP(t *testing.T) {
+	f, cleanup := newIndexFixtures(t)
+	defer cleanup()
+	var lock sync.Mutex
+	requests := 0
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		lock.Lock()
+		requests++
+		lock.Unlock()
+		http.FileServer(http.Dir(f.dir)).ServeHTTP(w, r)
+	}))
+	defer server.Close()
+
+	base := server.URL + "/" + f.trusted
+	sources := []imageSource{
+		&testIndexSource{index: base + "/SHA256SUMS", signature: f.serverURL + "/" + f.trusted + "/SHA256SUMS.sig"},
+		&testIndexSource{index: f.serverURL + "/" + f.trusted + "/SHA256SUMS", signature: base + "/SHA256SUMS.sig"},
+		&testIndexSource{index: base + "/SHA256SUMS", signature: base + "/SHA256SUMS.asc"},
+		&testOriginSource{testIndexSource{index: base + "/SHA256SUMS"}},
+	}
+	for _, src := range sources {
+		_, err := fetchVerifiedIndex(src, f.workDir, false)
+		if err == nil || !strings.Contains(err.Error(), "https") {
+			t.Errorf("%s with signature %q: got %v", src.indexURL(), src.signatureURL(), err)
+		}
+	}
+	if requests > 0 {
+		t.Errorf("made %d requests without https", requests)
+	}
+}
+
+func TestFetchVerifiedIndexOfHTTPSOrigin(t *testing.T) {
+	f, cleanup := newIndexFixtures(t)
+	defer cleanup()
+
+	src := &testOriginSource{testIndexSource{index: f.serverURL + "/" + f.untrusted + "/SHA256SUMS"}}
+	index, err := fetchVerifiedIndex(src, f.workDir, false)
+	if err != nil || string(index) != testIndex {
+		t.Errorf("an unsigned index from its https origin resulted in %q, %v", index, err)
+	}
+	mirror := &testOriginSource{testIndexSource{index: f.fileURL + "/" + f.untrusted + "/SHA256SUMS"}}
+	_, err = fetchVerifiedIndex(mirror, f.workDir, false)
+	if err == nil {
+		t.Error("an unsigned index from a mirror was trusted")
+	}
+}
+
+func TestCheckSecureURL(t *testing.T) {
+	cases := []struct {
+		location string
+		secure   bool
+	}{
+		{"https://cloud.centos.org/centos/7/atomic/images/sha256sum.txt.asc", true},
+		{"file:///media/mirror/sha256sum.txt", true},
+		{"http://cloud.centos.org/centos/7/atomic/images/sha256sum.txt", false},
+		{"ftp://mirror.example.com/sha256sum.txt", false},
+		{"/media/mirror/sha256sum.txt", false},
+	}
+	for _, c := range cases {
+		err := checkSecureURL(c.location)
+		if (err == nil) != c.secure {
+			t.Errorf("%s: got %v", c.location, err)
+		}
+	}
+}
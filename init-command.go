@@ -1,10 +1,10 @@
 package main
 
 import (
-	"bufio"
 	"fmt"
-	"net/http"
+	"io/ioutil"
 	"os"
+	"strings"
 
 	"github.com/urfave/cli"
 )
@@ -13,69 +13,128 @@ func initNodeManagerCommand(c *cli.Context) error {
 
 	workDir := getProjectDir(c)
 
-	indexPath := fmt.Sprintf("%s/base/index.txt", workDir)
+	conf, err := readConfig(workDir)
+	if err != nil {
+		return err
+	}
+	ref, err := parseImageRef(c.String("image"))
+	if err != nil {
+		return err
+	}
+	ref = ref.withDefaultVersion(conf)
+	src, err := lookupImageSourceWithFlags(c, workDir, ref.source)
+	if err != nil {
+		return err
+	}
+
+	indexPath := fmt.Sprintf("%s/index", sourceDir(workDir, src.name()))
 
 	force := c.Bool("force")
+	refreshIndex := force || c.String("index-file") != ""
+	versions := c.StringSlice("version")
+	if len(versions) == 0 {
+		versions = []string{ref.version}
+	}
 
-	if _, err := os.Stat(indexPath); !os.IsNotExist(err) && !force {
+	_, err = os.Stat(indexPath)
+	if !os.IsNotExist(err) && !refreshIndex && len(c.StringSlice("version")) == 0 {
 		fmt.Println("node-manager already initialized. Skipping. Run with --force to force overwrite.")
 		return nil
 	}
 
-	err := os.MkdirAll(fmt.Sprintf("%s/images", workDir), os.ModePerm)
-	if err != nil {
+	downloads, err := resolveDownloads(workDir, src, versions, force, refreshIndex, c.Bool("insecure"))
+	if err != nil || len(downloads) == 0 {
 		return err
 	}
+	return downloadEntries(workDir, downloads, c.Int("jobs"))
+}
 
-	err = os.MkdirAll(fmt.Sprintf("%s/base/images", workDir), os.ModePerm)
+// resolveDownloads makes sure that the index of src is present and returns
+// the entries of versions that still need to be downloaded. With force,
+// present images are downloaded again unless a node uses them.
+func resolveDownloads(workDir string, src imageSource, versions []string, force, refreshIndex, insecure bool) ([]*IndexEntry, error) {
+	indexEntries, err := ensureIndex(workDir, src, refreshIndex, insecure)
 	if err != nil {
-		return err
+		return nil, err
 	}
 
-	err = downloadIndex("https://cloud.centos.org/centos/7/atomic/images/sha256sum.txt", workDir)
+	downloads := make([]*IndexEntry, 0)
+	for _, version := range versions {
+		entry, err := selectIndexEntry(indexEntries, version)
+		if err != nil {
+			return nil, err
+		}
+		if entry.isPresent && !force {
+			fmt.Printf("%s is already present\n", entry)
+			continue
+		}
+		if entry.isPresent {
+			nodes, err := nodesUsingImage(workDir, entry)
+			if err != nil {
+				return nil, err
+			}
+			if len(nodes) > 0 {
+				return nil, fmt.Errorf("can not replace %s, it is used by %s", entry, strings.Join(nodes, ", "))
+			}
+		}
+		if !entryInSlice(entry, downloads) {
+			downloads = append(downloads, entry)
+		}
+	}
+	return downloads, nil
+}
 
+// ensureIndex downloads the index of src if it is missing or refresh is set
+// and reads it.
+func ensureIndex(workDir string, src imageSource, refresh, insecure bool) ([]*IndexEntry, error) {
+	baseDir := sourceDir(workDir, src.name())
+	err := os.MkdirAll(fmt.Sprintf("%s/images", workDir), os.ModePerm)
 	if err != nil {
-		return err
+		return nil, err
 	}
 
-	indexEntries, err := readIndex(workDir)
+	err = os.MkdirAll(fmt.Sprintf("%s/images", baseDir), os.ModePerm)
 	if err != nil {
-		return err
+		return nil, err
 	}
 
-	latest := indexEntries[len(indexEntries)-1]
-
-	fmt.Println("Downloading " + latest.fileName)
-	return latest.Download(workDir)
+	_, err = os.Stat(fmt.Sprintf("%s/index", baseDir))
+	if os.IsNotExist(err) || refresh {
+		err = downloadIndex(src, workDir, insecure)
+		if err != nil {
+			return nil, err
+		}
+	}
+	return readIndex(workDir, src)
 }
 
-func downloadIndex(url, workDir string) error {
-
-	location := fmt.Sprintf("%s/base/index.txt", workDir)
-	resp, err := http.Get(url)
-
+// lookupImageSourceWithFlags applies --mirror and --index-file of the
+// command to the image source called name.
+func lookupImageSourceWithFlags(c *cli.Context, workDir, name string) (imageSource, error) {
+	src, err := lookupImageSource(workDir, name)
 	if err != nil {
-		return err
+		return nil, err
 	}
-	defer resp.Body.Close()
-	scanner := bufio.NewScanner(resp.Body)
-	f, err := os.Create(location)
-	if err != nil {
-		return err
+	if c.String("mirror") == "" && c.String("index-file") == "" {
+		return src, nil
 	}
-	defer f.Close()
-
-	for scanner.Scan() {
-		entry := scanner.Text()
+	return newMirroredSource(src, c.String("index-file"), c.String("mirror"))
+}
 
-		_, err := parseIndexEntry(entry, workDir)
-		if err != nil {
-			continue
-		}
-		_, err = fmt.Fprintln(f, entry)
-		if err != nil {
-			return err
+func entryInSlice(entry *IndexEntry, entries []*IndexEntry) bool {
+	for _, e := range entries {
+		if e == entry {
+			return true
 		}
 	}
-	return scanner.Err()
+	return false
+}
+
+func downloadIndex(src imageSource, workDir string, insecure bool) error {
+	location := fmt.Sprintf("%s/index", sourceDir(workDir, src.name()))
+	index, err := fetchVerifiedIndex(src, workDir, insecure)
+	if err != nil {
+		return err
+	}
+	return ioutil.WriteFile(location, index, 0644)
 }
@@ -0,0 +1,331 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"io"
+	"os"
+	"sort"
+	"strings"
+	"time"
+	"unicode/utf16"
+)
+
+const ISO_SECTOR_SIZE = 2048
+
+// isoImage is a minimal ISO9660 image with Joliet and Rock Ridge
+// extensions. It only supports regular files in the root directory, which is
+// all a cloud-init NoCloud seed needs. Rock Ridge keeps the names and the
+// modes of the files, Joliet the names for readers without Rock Ridge.
+type isoImage struct {
+	volumeID string
+	files    []isoFile
+	modTime  time.Time
+}
+
+type isoFile struct {
+	name    string
+	content []byte
+	mode    os.FileMode
+}
+
+func newISOImage(volumeID string) *isoImage {
+	return &isoImage{volumeID: volumeID, modTime: time.Now()}
+}
+
+// addFile adds a file that is owned by root and has the permissions of mode.
+func (i *isoImage) addFile(name string, content []byte, mode os.FileMode) {
+	i.files = append(i.files, isoFile{name, content, mode.Perm()})
+}
+
+// WriteTo writes the image. The layout is: system area, primary, Joliet and
+// terminating volume descriptors, the four path tables, both root
+// directories and finally the file contents.
+func (i *isoImage) WriteTo(w io.Writer) (int64, error) {
+	files := append([]isoFile{}, i.files...)
+	sort.Slice(files, func(a, b int) bool {
+		return files[a].name < files[b].name
+	})
+
+	const (
+		primaryPathTableL = 19 + iota
+		primaryPathTableM
+		jolietPathTableL
+		jolietPathTableM
+		primaryRoot
+	)
+
+	primaryNames := make([][]byte, len(files))
+	jolietNames := make([][]byte, len(files))
+	for n, file := range files {
+		primaryNames[n] = []byte(isoPrimaryName(file.name))
+		jolietNames[n] = ucs2(file.name)
+	}
+	noExtents := make([]uint32, len(files))
+	primarySectors := directorySectors(i.rootRecords(0, 0, primaryNames, noExtents, files, true))
+	jolietSectors := directorySectors(i.rootRecords(0, 0, jolietNames, noExtents, files, false))
+	jolietRoot := primaryRoot + primarySectors
+
+	extents := make([]uint32, len(files))
+	sector := jolietRoot + jolietSectors
+	for n, file := range files {
+		extents[n] = sector
+		sector += sectorsFor(len(file.content))
+	}
+	totalSectors := sector
+
+	buf := &bytes.Buffer{}
+	buf.Write(make([]byte, 16*ISO_SECTOR_SIZE))
+	buf.Write(i.volumeDescriptor(1, primaryRoot, primarySectors, primaryPathTableL, primaryPathTableM, totalSectors))
+	buf.Write(i.volumeDescriptor(2, jolietRoot, jolietSectors, jolietPathTableL, jolietPathTableM, totalSectors))
+
+	terminator := make([]byte, ISO_SECTOR_SIZE)
+	terminator[0] = 255
+	copy(terminator[1:], "CD001")
+	terminator[6] = 1
+	buf.Write(terminator)
+
+	buf.Write(pathTable(primaryRoot, binary.LittleEndian))
+	buf.Write(pathTable(primaryRoot, binary.BigEndian))
+	buf.Write(pathTable(jolietRoot, binary.LittleEndian))
+	buf.Write(pathTable(jolietRoot, binary.BigEndian))
+
+	buf.Write(packDirectory(i.rootRecords(primaryRoot, primarySectors, primaryNames, extents, files, true), primarySectors))
+	buf.Write(packDirectory(i.rootRecords(jolietRoot, jolietSectors, jolietNames, extents, files, false), jolietSectors))
+
+	for _, file := range files {
+		buf.Write(file.content)
+		buf.Write(make([]byte, int(sectorsFor(len(file.content)))*ISO_SECTOR_SIZE-len(file.content)))
+	}
+
+	return buf.WriteTo(w)
+}
+
+func (i *isoImage) volumeDescriptor(kind byte, root, rootSectors, pathTableL, pathTableM, totalSectors uint32) []byte {
+	joliet := kind == 2
+	text := func(s string, length int) []byte {
+		if joliet {
+			return padded(ucs2(s), length, []byte{0, ' '})
+		}
+		return padded([]byte(s), length, []byte{' '})
+	}
+
+	d := make([]byte, ISO_SECTOR_SIZE)
+	d[0] = kind
+	copy(d[1:], "CD001")
+	d[6] = 1
+	copy(d[8:40], text("LINUX", 32))
+	copy(d[40:72], text(i.volumeID, 32))
+	putBothEndian32(d[80:], totalSectors)
+	if joliet {
+		// UCS-2 level 3
+		copy(d[88:], "%/E")
+	}
+	putBothEndian16(d[120:], 1)
+	putBothEndian16(d[124:], 1)
+	putBothEndian16(d[128:], ISO_SECTOR_SIZE)
+	putBothEndian32(d[132:], 10)
+	binary.LittleEndian.PutUint32(d[140:], pathTableL)
+	binary.BigEndian.PutUint32(d[148:], pathTableM)
+	copy(d[156:190], i.directoryRecord([]byte{0}, root, rootSectors*ISO_SECTOR_SIZE, true, nil))
+	copy(d[190:318], text("", 128))
+	copy(d[318:446], text("", 128))
+	copy(d[446:574], text("", 128))
+	copy(d[574:702], text("NODE-MANAGER", 128))
+	copy(d[702:739], text("", 37))
+	copy(d[739:776], text("", 37))
+	copy(d[776:813], text("", 37))
+	copy(d[813:830], isoDateTime(i.modTime))
+	copy(d[830:847], isoDateTime(i.modTime))
+	copy(d[847:864], isoDateTime(time.Time{}))
+	copy(d[864:881], isoDateTime(time.Time{}))
+	d[881] = 1
+	return d
+}
+
+// rootRecords describes the root directory of sectors sectors and its
+// files. The records of the primary volume carry the Rock Ridge entries.
+// The length of the records does not depend on root, sectors and extents.
+func (i *isoImage) rootRecords(root, sectors uint32, names [][]byte, extents []uint32, files []isoFile, rockRidge bool) [][]byte {
+	size := sectors * ISO_SECTOR_SIZE
+	var self, parent []byte
+	if rockRidge {
+		self = append(append(append(susp("SP", 0xbe, 0xef, 0), rrFlags()...), rrAttributes(os.ModeDir|0555)...), rrExtension()...)
+		parent = append(rrFlags(), rrAttributes(os.ModeDir|0555)...)
+	}
+	records := [][]byte{
+		i.directoryRecord([]byte{0}, root, size, true, self),
+		i.directoryRecord([]byte{1}, root, size, true, parent),
+	}
+	for n, file := range files {
+		var systemUse []byte
+		if rockRidge {
+			systemUse = append(append(rrFlags(), rrAttributes(file.mode)...), susp("NM", append([]byte{0}, file.name...)...)...)
+		}
+		records = append(records, i.directoryRecord(names[n], extents[n], uint32(len(file.content)), false, systemUse))
+	}
+	return records
+}
+
+// packDirectory places records into sectors sectors. Records must not cross
+// sector boundaries, so a sector without room for the next record is
+// padded.
+func packDirectory(records [][]byte, sectors uint32) []byte {
+	dir := &bytes.Buffer{}
+	for _, record := range records {
+		if free := ISO_SECTOR_SIZE - dir.Len()%ISO_SECTOR_SIZE; len(record) > free {
+			dir.Write(make([]byte, free))
+		}
+		dir.Write(record)
+	}
+	return padded(dir.Bytes(), int(sectors*ISO_SECTOR_SIZE), []byte{0})
+}
+
+// directorySectors counts the sectors that packDirectory needs for records.
+func directorySectors(records [][]byte) uint32 {
+	sectors := uint32(1)
+	used := 0
+	for _, record := range records {
+		if used+len(record) > ISO_SECTOR_SIZE {
+			sectors++
+			used = 0
+		}
+		used += len(record)
+	}
+	return sectors
+}
+
+// susp encodes an entry of the System Use Sharing Protocol, which Rock
+// Ridge builds on.
+func susp(signature string, data ...byte) []byte {
+	return append([]byte{signature[0], signature[1], byte(4 + len(data)), 1}, data...)
+}
+
+// rrFlags announces the Rock Ridge entries of a record, PX and NM, for
+// readers of the 1.09 specification.
+func rrFlags() []byte {
+	return susp("RR", 0x01|0x08)
+}
+
+// rrAttributes encodes the POSIX mode, owned by root, as PX entry.
+func rrAttributes(mode os.FileMode) []byte {
+	posixMode := uint32(mode.Perm())
+	links := uint32(1)
+	if mode.IsDir() {
+		posixMode |= 0040000
+		links = 2
+	} else {
+		posixMode |= 0100000
+	}
+	data := make([]byte, 32)
+	putBothEndian32(data[0:], posixMode)
+	putBothEndian32(data[8:], links)
+	return susp("PX", data...)
+}
+
+// rrExtension identifies Rock Ridge in the first record of the root.
+func rrExtension() []byte {
+	id := "RRIP_1991A"
+	description := "THE ROCK RIDGE INTERCHANGE PROTOCOL PROVIDES SUPPORT FOR POSIX FILE SYSTEM SEMANTICS"
+	data := []byte{byte(len(id)), byte(len(description)), 0, 1}
+	data = append(append(data, id...), description...)
+	return susp("ER", data...)
+}
+
+func (i *isoImage) directoryRecord(identifier []byte, extent, size uint32, isDir bool, systemUse []byte) []byte {
+	// the identifier is padded to an even length, the record as well
+	length := 33 + len(identifier)
+	if length%2 != 0 {
+		length++
+	}
+	systemUseOffset := length
+	length += len(systemUse)
+	if length%2 != 0 {
+		length++
+	}
+	r := make([]byte, length)
+	r[0] = byte(length)
+	putBothEndian32(r[2:], extent)
+	putBothEndian32(r[10:], size)
+	t := i.modTime.UTC()
+	r[18] = byte(t.Year() - 1900)
+	r[19] = byte(t.Month())
+	r[20] = byte(t.Day())
+	r[21] = byte(t.Hour())
+	r[22] = byte(t.Minute())
+	r[23] = byte(t.Second())
+	if isDir {
+		r[25] = 2
+	}
+	putBothEndian16(r[28:], 1)
+	r[32] = byte(len(identifier))
+	copy(r[33:], identifier)
+	copy(r[systemUseOffset:], systemUse)
+	return r
+}
+
+// pathTable only has to describe the root directory.
+func pathTable(root uint32, order binary.ByteOrder) []byte {
+	t := make([]byte, ISO_SECTOR_SIZE)
+	t[0] = 1
+	order.PutUint32(t[2:], root)
+	order.PutUint16(t[6:], 1)
+	return t
+}
+
+// isoPrimaryName maps a file name to the restricted d-characters of plain
+// ISO9660. Readers with Joliet support use the original name instead.
+func isoPrimaryName(name string) string {
+	mapped := strings.Map(func(r rune) rune {
+		switch {
+		case r >= 'A' && r <= 'Z', r >= '0' && r <= '9', r == '_':
+			return r
+		case r >= 'a' && r <= 'z':
+			return r - 'a' + 'A'
+		}
+		return '_'
+	}, name)
+	if len(mapped) > 30 {
+		mapped = mapped[:30]
+	}
+	return mapped + ".;1"
+}
+
+func isoDateTime(t time.Time) []byte {
+	if t.IsZero() {
+		return append([]byte("0000000000000000"), 0)
+	}
+	return append([]byte(t.UTC().Format("20060102150405")+"00"), 0)
+}
+
+func ucs2(s string) []byte {
+	encoded := utf16.Encode([]rune(s))
+	result := make([]byte, 2*len(encoded))
+	for n, c := range encoded {
+		binary.BigEndian.PutUint16(result[2*n:], c)
+	}
+	return result
+}
+
+func padded(b []byte, length int, filler []byte) []byte {
+	result := make([]byte, 0, length)
+	result = append(result, b...)
+	for len(result) < length {
+		result = append(result, filler...)
+	}
+	return result[:length]
+}
+
+func sectorsFor(size int) uint32 {
+	return uint32((size + ISO_SECTOR_SIZE - 1) / ISO_SECTOR_SIZE)
+}
+
+func putBothEndian16(b []byte, v uint16) {
+	binary.LittleEndian.PutUint16(b, v)
+	binary.BigEndian.PutUint16(b[2:], v)
+}
+
+func putBothEndian32(b []byte, v uint32) {
+	binary.LittleEndian.PutUint32(b, v)
+	binary.BigEndian.PutUint32(b[4:], v)
+}
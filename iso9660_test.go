@@ -0,0 +1,200 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"os"
+	"strings"
+	"testing"
+	"unicode/utf16"
+)
+
+// isoEntry is a file read back from an image. Its Rock Ridge name and mode
+// are only set for the primary volume.
+type isoEntry struct {
+	content []byte
+	rrName  string
+	mode    os.FileMode
+}
+
+// readISO parses the volume descriptor in sector and the root directory it
+// points to. It returns the volume label, every file by its identifier and
+// the system use area of the first record of the root.
+func readISO(t *testing.T, image []byte, sector int, joliet bool) (string, map[string]isoEntry, []byte) {
+	d := image[sector*ISO_SECTOR_SIZE : (sector+1)*ISO_SECTOR_SIZE]
+	kind := byte(1)
+	if joliet {
+		kind = 2
+	}
+	if d[0] != kind || string(d[1:6]) != "CD001" {
+		t.Fatalf("sector %d holds no volume descriptor of type %d", sector, kind)
+	}
+	if joliet && string(d[88:91]) != "%/E" {
+		t.Fatalf("the supplementary volume descriptor does not announce Joliet")
+	}
+	decode := func(b []byte) string {
+		if !joliet {
+			return string(b)
+		}
+		chars := make([]uint16, len(b)/2)
+		for n := range chars {
+			chars[n] = binary.BigEndian.Uint16(b[2*n:])
+		}
+		return string(utf16.Decode(chars))
+	}
+	label := strings.TrimRight(decode(d[40:72]), " ")
+	if total := int(binary.LittleEndian.Uint32(d[80:])); total*ISO_SECTOR_SIZE != len(image) {
+		t.Errorf("volume has %d sectors, but the image %d bytes", total, len(image))
+	}
+
+	root := d[156:190]
+	extent := int(binary.LittleEndian.Uint32(root[2:]))
+	size := int(binary.LittleEndian.Uint32(root[10:]))
+	dir := image[extent*ISO_SECTOR_SIZE : extent*ISO_SECTOR_SIZE+size]
+
+	files := make(map[string]isoEntry)
+	var rootSystemUse []byte
+	for offset := 0; offset < len(dir); {
+		length := int(dir[offset])
+		if length == 0 {
+			// the rest of the sector is padding
+			offset = (offset/ISO_SECTOR_SIZE + 1) * ISO_SECTOR_SIZE
+			continue
+		}
+		record := dir[offset : offset+length]
+		if offset/ISO_SECTOR_SIZE != (offset+length-1)/ISO_SECTOR_SIZE {
+			t.Errorf("record at %d crosses a sector boundary", offset)
+		}
+		if length%2 != 0 {
+			t.Errorf("record at %d has the odd length %d", offset, length)
+		}
+		identifier := record[33 : 33+int(record[32])]
+		systemUse := record[33+len(identifier)+1-len(identifier)%2:]
+		if offset == 0 {
+			rootSystemUse = systemUse
+		}
+		offset += length
+		if record[25]&2 != 0 {
+			continue
+		}
+		fileExtent := int(binary.LittleEndian.Uint32(record[2:]))
+		fileSize := int(binary.LittleEndian.Uint32(record[10:]))
+		entry := isoEntry{content: image[fileExtent*ISO_SECTOR_SIZE : fileExtent*ISO_SECTOR_SIZE+fileSize]}
+		entries := suspEntries(t, systemUse)
+		if name, ok := entries["NM"]; ok {
+			entry.rrName = string(name[1:])
+		}
+		if px, ok := entries["PX"]; ok {
+			entry.mode = os.FileMode(binary.LittleEndian.Uint32(px))
+		}
+		files[decode(identifier)] = entry
+	}
+	return label, files, rootSystemUse
+}
+
+// suspEntries splits a system use area into its entries by signature.
+func suspEntries(t *testing.T, systemUse []byte) map[string][]byte {
+	entries := make(map[string][]byte)
+	for len(systemUse) >= 4 {
+		length := int(systemUse[2])
+		if length < 4 || length > len(systemUse) {
+			t.Fatalf("invalid system use entry %q", systemUse)
+		}
+		entries[string(systemUse[:2])] = systemUse[4:length]
+		systemUse = systemUse[length:]
+	}
+	return entries
+}
+
+func testFileMode(name string) os.FileMode {
+	if name == "user-data" {
+		return 0600
+	}
+	return 0644
+}
+
+func writeISO(t *testing.T, files map[string][]byte) []byte {
+	iso := newISOImage("cidata")
+	for name, content := range files {
+		iso.addFile(name, content, testFileMode(name))
+	}
+	buf := &bytes.Buffer{}
+	n, err := iso.WriteTo(buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if int(n) != buf.Len() || n%ISO_SECTOR_SIZE != 0 {
+		t.Fatalf("wrote %d bytes, which is no whole number of sectors", n)
+	}
+	return buf.Bytes()
+}
+
+func checkISO(t *testing.T, image []byte, expected map[string][]byte) {
+	for _, joliet := range []bool{false, true} {
+		sector := 16
+		if joliet {
+			sector = 17
+		}
+		label, files, rootSystemUse := readISO(t, image, sector, joliet)
+		if label != "cidata" {
+			t.Errorf("joliet %v: volume label is %q", joliet, label)
+		}
+		rootEntries := suspEntries(t, rootSystemUse)
+		if _, ok := rootEntries["SP"]; ok == joliet {
+			t.Errorf("joliet %v: Rock Ridge is announced %v", joliet, ok)
+		}
+		if er, ok := rootEntries["ER"]; !joliet && (!ok || string(er[4:4+int(er[0])]) != "RRIP_1991A") {
+			t.Errorf("the root does not identify Rock Ridge: %q", er)
+		}
+		if len(files) != len(expected) {
+			t.Errorf("joliet %v: found %d files, expected %d", joliet, len(files), len(expected))
+		}
+		for name, content := range expected {
+			identifier := name
+			if !joliet {
+				identifier = isoPrimaryName(name)
+			}
+			actual, ok := files[identifier]
+			if !ok {
+				t.Errorf("joliet %v: %s is missing", joliet, identifier)
+				continue
+			}
+			if !bytes.Equal(actual.content, content) {
+				t.Errorf("joliet %v: %s contains %q, expected %q", joliet, identifier, actual.content, content)
+			}
+			if joliet {
+				continue
+			}
+			if actual.rrName != name {
+				t.Errorf("the Rock Ridge name of %s is %q", identifier, actual.rrName)
+			}
+			if expectedMode := 0100000 | testFileMode(name); actual.mode != expectedMode {
+				t.Errorf("the Rock Ridge mode of %s is %o, expected %o", name, actual.mode, expectedMode)
+			}
+		}
+	}
+}
+
+func TestSeedISO(t *testing.T) {
+	expected := map[string][]byte{
+		"user-data":      []byte("#cloud-config\npassword: secret\n"),
+		"meta-data":      []byte("instance-id: atomic-host1\nlocal-hostname: atomic1\n"),
+		"network-config": bytes.Repeat([]byte("x"), 3*ISO_SECTOR_SIZE+1),
+		"empty":          nil,
+	}
+	checkISO(t, writeISO(t, expected), expected)
+}
+
+func TestISOWithDirectoryOverSeveralSectors(t *testing.T) {
+	expected := make(map[string][]byte)
+	for n := 0; n < 100; n++ {
+		expected[fmt.Sprintf("seed-file-number-%03d-of-many", n)] = []byte(fmt.Sprintf("content %d", n))
+	}
+	image := writeISO(t, expected)
+	root := image[16*ISO_SECTOR_SIZE+156:]
+	if size := binary.LittleEndian.Uint32(root[10:]); size < 2*ISO_SECTOR_SIZE {
+		t.Fatalf("the root directory takes up only %d bytes", size)
+	}
+	checkISO(t, image, expected)
+}
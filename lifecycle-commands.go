@@ -0,0 +1,174 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	libvirt "github.com/libvirt/libvirt-go"
+	"github.com/urfave/cli"
+)
+
+var selectionFlags = []cli.Flag{
+	cli.BoolFlag{
+		Name:  "all, a",
+		Usage: "Apply to all nodes",
+	},
+}
+
+func startNodesCommand(c *cli.Context) error {
+	return forSelectedNodes(c, "started", func(dom *libvirt.Domain, name string) error {
+		active, err := dom.IsActive()
+		if err != nil || active {
+			return err
+		}
+		return dom.Create()
+	})
+}
+
+func stopNodesCommand(c *cli.Context) error {
+	timeout := c.Duration("timeout")
+	return forSelectedNodes(c, "stopped", func(dom *libvirt.Domain, name string) error {
+		return stopNode(dom, timeout)
+	})
+}
+
+func rebootNodesCommand(c *cli.Context) error {
+	return forSelectedNodes(c, "rebooted", func(dom *libvirt.Domain, name string) error {
+		return dom.Reboot(libvirt.DOMAIN_REBOOT_DEFAULT)
+	})
+}
+
+func suspendNodesCommand(c *cli.Context) error {
+	return forSelectedNodes(c, "suspended", func(dom *libvirt.Domain, name string) error {
+		return dom.Suspend()
+	})
+}
+
+func resumeNodesCommand(c *cli.Context) error {
+	return forSelectedNodes(c, "resumed", func(dom *libvirt.Domain, name string) error {
+		return dom.Resume()
+	})
+}
+
+// stopNode asks the guest to power off through ACPI and pulls the plug if
+// it is still running after timeout.
+func stopNode(dom *libvirt.Domain, timeout time.Duration) error {
+	active, err := dom.IsActive()
+	if err != nil || !active {
+		return err
+	}
+	err = dom.ShutdownFlags(libvirt.DOMAIN_SHUTDOWN_ACPI_POWER_BTN)
+	if err != nil {
+		return err
+	}
+	deadline := time.Now().Add(timeout)
+	for time.Now().Before(deadline) {
+		time.Sleep(time.Second)
+		active, err = dom.IsActive()
+		if err != nil || !active {
+			return err
+		}
+	}
+	return dom.Destroy()
+}
+
+// selectedNodes returns the node numbers given as arguments. Both plain
+// numbers and full node names are accepted. A nil result means all nodes.
+func selectedNodes(c *cli.Context) (map[string]bool, error) {
+	if c.Bool("all") {
+		return nil, nil
+	}
+	if !c.Args().Present() {
+		return nil, fmt.Errorf("no nodes given. Pass node ids or --all")
+	}
+	nodeNumbers := make(map[string]bool)
+	for _, arg := range c.Args() {
+		nodeNumbers[strings.TrimPrefix(arg, "atomic-host")] = true
+	}
+	return nodeNumbers, nil
+}
+
+// forSelectedNodes runs action for every selected node in parallel and
+// reports the outcome per node.
+func forSelectedNodes(c *cli.Context, done string, action func(*libvirt.Domain, string) error) error {
+	nodeNumbers, err := selectedNodes(c)
+	if err != nil {
+		return err
+	}
+
+	conn, err := connect(c)
+	if err != nil {
+		log.Fatal(err)
+	}
+	defer conn.Close()
+
+	return forNodesInParallel(conn, nodeNumbers, done, action)
+}
+
+// forNodesInParallel runs action for the nodes in nodeNumbers, or all nodes
+// if it is nil. Requested nodes that do not exist count as failed.
+func forNodesInParallel(conn *libvirt.Connect, nodeNumbers map[string]bool, done string, action func(*libvirt.Domain, string) error) error {
+	names := make([]string, 0)
+	found := make(map[string]bool)
+	err := forEachNode(conn, func(dom *libvirt.Domain, name, nodeNumber string) error {
+		if nodeNumbers == nil || nodeNumbers[nodeNumber] {
+			names = append(names, name)
+			found[nodeNumber] = true
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	missing := make(map[string]bool)
+	for nodeNumber := range nodeNumbers {
+		if !found[nodeNumber] {
+			name := fmt.Sprintf("atomic-host%s", nodeNumber)
+			names = append(names, name)
+			missing[name] = true
+		}
+	}
+	if len(names) == 0 {
+		return fmt.Errorf("no matching nodes found")
+	}
+	sort.Strings(names)
+
+	results := make([]error, len(names))
+	var wg sync.WaitGroup
+	for i, name := range names {
+		if missing[name] {
+			results[i] = fmt.Errorf("no such node")
+			continue
+		}
+		wg.Add(1)
+		go func(i int, name string) {
+			defer wg.Done()
+			dom, err := conn.LookupDomainByName(name)
+			if err != nil {
+				results[i] = err
+				return
+			}
+			defer dom.Free()
+			results[i] = action(dom, name)
+		}(i, name)
+	}
+	wg.Wait()
+
+	failed := 0
+	for i, name := range names {
+		if results[i] != nil {
+			failed++
+			fmt.Printf("%s: failed: %s\n", name, results[i])
+			continue
+		}
+		fmt.Printf("%s: %s\n", name, done)
+	}
+	if failed > 0 {
+		return fmt.Errorf("%d of %d nodes failed", failed, len(names))
+	}
+	return nil
+}
@@ -1,28 +1,205 @@
 package main
 
 import (
+	"encoding/json"
 	"fmt"
+	"os"
+	"strings"
+	"text/tabwriter"
 
 	libvirt "github.com/libvirt/libvirt-go"
 	"github.com/urfave/cli"
+	yaml "gopkg.in/yaml.v2"
 )
 
+type nodeInfo struct {
+	ID        string   `json:"id" yaml:"id"`
+	Name      string   `json:"name" yaml:"name"`
+	State     string   `json:"state" yaml:"state"`
+	CPUs      uint     `json:"cpus" yaml:"cpus"`
+	Memory    uint64   `json:"memoryMiB" yaml:"memoryMiB"`
+	DiskUsed  uint64   `json:"diskUsedBytes" yaml:"diskUsedBytes"`
+	DiskSize  uint64   `json:"diskSizeBytes" yaml:"diskSizeBytes"`
+	Image     string   `json:"image" yaml:"image"`
+	Flavor    string   `json:"flavor" yaml:"flavor"`
+	Group     string   `json:"group" yaml:"group"`
+	VNCPort   int      `json:"vncPort,omitempty" yaml:"vncPort,omitempty"`
+	Addresses []string `json:"addresses" yaml:"addresses"`
+}
+
 func listNodesCommand(c *cli.Context) error {
-	conn, err := libvirt.NewConnect("qemu:///session")
+	output := c.String("output")
+	if !stringInSlice(output, []string{"table", "wide", "json", "yaml"}) {
+		return fmt.Errorf("unknown output format %s. Use table, wide, json or yaml", output)
+	}
+
+	conn, err := connect(c)
 	if err != nil {
 		return err
 	}
-	fmt.Printf("id\tname\tactive\n")
-	return forEachNode(conn, func(dom *libvirt.Domain, name, number string) error {
-		active, err := dom.IsActive()
+	defer conn.Close()
+
+	nodes := make([]*nodeInfo, 0)
+	err = forEachNode(conn, func(dom *libvirt.Domain, name, number string) error {
+		info, err := getNodeInfo(dom, name, number)
 		if err != nil {
 			return err
 		}
-		activeIndicator := "\u2713"
-		if !active {
-			activeIndicator = "\u2717"
-		}
-		fmt.Printf("%s\t%s\t%s\n", number, name, activeIndicator)
+		nodes = append(nodes, info)
 		return nil
 	})
+	if err != nil {
+		return err
+	}
+
+	switch output {
+	case "json":
+		encoder := json.NewEncoder(os.Stdout)
+		encoder.SetIndent("", "  ")
+		return encoder.Encode(nodes)
+	case "yaml":
+		raw, err := yaml.Marshal(nodes)
+		if err != nil {
+			return err
+		}
+		_, err = os.Stdout.Write(raw)
+		return err
+	}
+
+	wide := output == "wide"
+	w := tabwriter.NewWriter(os.Stdout, 0, 8, 2, ' ', 0)
+	if wide {
+		fmt.Fprintln(w, "ID\tNAME\tSTATE\tADDRESSES\tFLAVOR\tCPUS\tMEMORY\tDISK\tIMAGE\tVNC\tGROUP")
+	} else {
+		fmt.Fprintln(w, "ID\tNAME\tSTATE\tADDRESSES\tFLAVOR")
+	}
+	for _, node := range nodes {
+		addresses := strings.Join(node.Addresses, ",")
+		if addresses == "" {
+			addresses = "-"
+		}
+		if !wide {
+			fmt.Fprintf(w, "%s\t%s\t%s\t%s\t%s\n", node.ID, node.Name, node.State, addresses, node.Flavor)
+			continue
+		}
+		vnc := "-"
+		if node.VNCPort > 0 {
+			vnc = fmt.Sprintf("%d", node.VNCPort)
+		}
+		fmt.Fprintf(w, "%s\t%s\t%s\t%s\t%s\t%d\t%dM\t%s/%s\t%s\t%s\t%s\n",
+			node.ID, node.Name, node.State, addresses, node.Flavor, node.CPUs, node.Memory,
+			formatBytes(node.DiskUsed), formatBytes(node.DiskSize), node.Image, vnc, node.Group)
+	}
+	return w.Flush()
+}
+
+func getNodeInfo(dom *libvirt.Domain, name, number string) (*nodeInfo, error) {
+	info, err := dom.GetInfo()
+	if err != nil {
+		return nil, err
+	}
+	meta, err := getNodeMetadata(dom)
+	if err != nil {
+		return nil, err
+	}
+	node := &nodeInfo{
+		ID:        number,
+		Name:      name,
+		State:     stateName(info.State),
+		CPUs:      info.NrVirtCpu,
+		Memory:    info.MaxMem / 1024,
+		Image:     meta.Image,
+		Flavor:    meta.Flavor,
+		Group:     meta.Group,
+		Addresses: nodeAddresses(dom),
+	}
+
+	blockInfo, err := dom.GetBlockInfo("vda", 0)
+	if err == nil {
+		node.DiskUsed = blockInfo.Allocation
+		node.DiskSize = blockInfo.Capacity
+	}
+
+	def, err := readDomainDef(dom)
+	if err != nil {
+		return nil, err
+	}
+	for _, graphics := range def.Devices.Graphics {
+		// the port is -1 until an autoport domain is started
+		if graphics.Type == "vnc" && graphics.Port > 0 {
+			node.VNCPort = graphics.Port
+		}
+	}
+	return node, nil
+}
+
+// nodeAddresses collects the IP addresses of a node from the DHCP leases of
+// libvirt networks, from the guest agent and from its static configuration.
+// Sources that are not available are skipped.
+func nodeAddresses(dom *libvirt.Domain) []string {
+	addresses := make([]string, 0)
+	sources := []libvirt.DomainInterfaceAddressesSource{
+		libvirt.DOMAIN_INTERFACE_ADDRESSES_SRC_LEASE,
+		libvirt.DOMAIN_INTERFACE_ADDRESSES_SRC_AGENT,
+	}
+	for _, source := range sources {
+		ifaces, err := dom.ListAllInterfaceAddresses(source)
+		if err != nil {
+			continue
+		}
+		for _, iface := range ifaces {
+			if iface.Name == "lo" {
+				continue
+			}
+			for _, addr := range iface.Addrs {
+				if strings.HasPrefix(addr.Addr, "fe80:") || stringInSlice(addr.Addr, addresses) {
+					continue
+				}
+				addresses = append(addresses, addr.Addr)
+			}
+		}
+	}
+	if meta, err := getNodeMetadata(dom); err == nil {
+		for _, address := range meta.Addresses {
+			ip := strings.Split(address, "/")[0]
+			if !stringInSlice(ip, addresses) {
+				addresses = append(addresses, ip)
+			}
+		}
+	}
+	return addresses
+}
+
+func stateName(state libvirt.DomainState) string {
+	switch state {
+	case libvirt.DOMAIN_RUNNING:
+		return "running"
+	case libvirt.DOMAIN_BLOCKED:
+		return "blocked"
+	case libvirt.DOMAIN_PAUSED:
+		return "paused"
+	case libvirt.DOMAIN_SHUTDOWN:
+		return "shutting down"
+	case libvirt.DOMAIN_SHUTOFF:
+		return "shut off"
+	case libvirt.DOMAIN_CRASHED:
+		return "crashed"
+	case libvirt.DOMAIN_PMSUSPENDED:
+		return "pm suspended"
+	}
+	return "unknown"
+}
+
+func formatBytes(size uint64) string {
+	units := []string{"B", "K", "M", "G", "T"}
+	value := float64(size)
+	unit := 0
+	for value >= 1024 && unit < len(units)-1 {
+		value /= 1024
+		unit++
+	}
+	if unit == 0 {
+		return fmt.Sprintf("%d%s", size, units[unit])
+	}
+	return fmt.Sprintf("%.1f%s", value, units[unit])
 }
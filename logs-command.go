@@ -0,0 +1,148 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"os"
+	"path/filepath"
+	"time"
+
+	libvirt "github.com/libvirt/libvirt-go"
+	"github.com/urfave/cli"
+)
+
+const MAX_LOG_TAIL = 64 * 1024
+
+func logsCommand(c *cli.Context) error {
+	if c.NArg() != 1 {
+		return fmt.Errorf("expected exactly one node id")
+	}
+	conn, err := connect(c)
+	if err != nil {
+		log.Fatal(err)
+	}
+	defer conn.Close()
+
+	dom, err := lookupNode(conn, c.Args().First())
+	if err != nil {
+		return err
+	}
+	defer dom.Free()
+	name, err := dom.GetName()
+	if err != nil {
+		return err
+	}
+	logFile, err := consoleLogFile(dom)
+	if err != nil {
+		return err
+	}
+	if logFile == "" {
+		return fmt.Errorf("%s has no console log. Use node-manager console %s instead", name, c.Args().First())
+	}
+
+	follow := c.Bool("follow")
+	info, err := os.Stat(logFile)
+	if os.IsNotExist(err) && !follow {
+		return fmt.Errorf("%s has not written to its console yet", name)
+	}
+	offset := int64(0)
+	if lines := c.Int("lines"); lines > 0 && err == nil {
+		tail, err := readLogTail(logFile, lines)
+		if err != nil {
+			return err
+		}
+		fmt.Println(tail)
+		offset = info.Size()
+	}
+	for {
+		offset, err = copyLog(logFile, offset, os.Stdout)
+		if err != nil || !follow {
+			return err
+		}
+		time.Sleep(500 * time.Millisecond)
+	}
+}
+
+// consoleLogPath is the file in nodeDir that the serial console of a node
+// is logged to. It is empty for remote hosts, where libvirt could not write
+// to nodeDir.
+func consoleLogPath(conn *libvirt.Connect, nodeDir string) (string, error) {
+	remote, err := isRemoteConnection(conn)
+	if err != nil || remote {
+		return "", err
+	}
+	return filepath.Abs(filepath.Join(nodeDir, "console.log"))
+}
+
+// consoleLogFile returns the file that the serial console of dom is logged
+// to or an empty string if it is not logged.
+func consoleLogFile(dom *libvirt.Domain) (string, error) {
+	def, err := readDomainDef(dom)
+	if err != nil {
+		return "", err
+	}
+	for _, serial := range def.Devices.Serials {
+		if serial.Log != nil {
+			return serial.Log.File, nil
+		}
+	}
+	return "", nil
+}
+
+// readLogTail returns the last lines of a console log.
+func readLogTail(path string, lines int) (string, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return "", err
+	}
+	defer file.Close()
+	info, err := file.Stat()
+	if err != nil {
+		return "", err
+	}
+	if info.Size() > MAX_LOG_TAIL {
+		_, err = file.Seek(info.Size()-MAX_LOG_TAIL, io.SeekStart)
+		if err != nil {
+			return "", err
+		}
+	}
+	content, err := ioutil.ReadAll(file)
+	if err != nil {
+		return "", err
+	}
+	return lastLines(string(bytes.Replace(content, []byte("\r"), nil, -1)), lines), nil
+}
+
+// copyLog writes what was logged to path after offset to out and returns
+// the new offset. A log that shrank has been replaced and is read again
+// from the start.
+func copyLog(path string, offset int64, out io.Writer) (int64, error) {
+	file, err := os.Open(path)
+	if os.IsNotExist(err) {
+		return offset, nil
+	}
+	if err != nil {
+		return offset, err
+	}
+	defer file.Close()
+	info, err := file.Stat()
+	if err != nil {
+		return offset, err
+	}
+	if info.Size() < offset {
+		offset = 0
+	}
+	_, err = file.Seek(offset, io.SeekStart)
+	if err != nil {
+		return offset, err
+	}
+	content, err := ioutil.ReadAll(file)
+	if err != nil {
+		return offset, err
+	}
+	_, err = out.Write(bytes.Replace(content, []byte("\r"), nil, -1))
+	return offset + int64(len(content)), err
+}
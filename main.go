@@ -3,10 +3,31 @@ package main
 import (
 	"log"
 	"os"
+	"time"
 
 	"github.com/urfave/cli"
 )
 
+var imageFlag = cli.StringFlag{
+	Name:  "image",
+	Usage: "Base image as <source>[:<version>]. Sources are centos-atomic, fedora-coreos[-<stream>], ubuntu-<release> and the ones in config.yaml. Defaults to the newest centos-atomic image.",
+}
+
+var mirrorFlag = cli.StringFlag{
+	Name:  "mirror",
+	Usage: "Directory or URL to fetch the index and the images from instead, e.g. file:///srv/images",
+}
+
+var insecureFlag = cli.BoolFlag{
+	Name:  "insecure",
+	Usage: "Accept indexes without a valid signature and fetch them without https. Unsigned sources like fedora-coreos only need it when their index comes from a mirror or file",
+}
+
+var indexFileFlag = cli.StringFlag{
+	Name:  "index-file",
+	Usage: "Use this file as index of the image source instead of downloading it",
+}
+
 func main() {
 	app := cli.NewApp()
 
@@ -17,27 +38,344 @@ func main() {
 			Name:   "add",
 			Usage:  "add a new node",
 			Action: addNode,
+			Flags: []cli.Flag{
+				imageFlag,
+				cli.StringFlag{
+					Name:  "image-version",
+					Usage: "Version of the base image, e.g. 1805. Defaults to the version pinned in config.yaml or the newest downloaded one.",
+				},
+				cli.StringFlag{
+					Name:  "flavor",
+					Usage: "Size of the node. Built in flavors are small, medium and large. More can be defined in config.yaml. Defaults to medium.",
+				},
+				cli.IntFlag{
+					Name:  "memory",
+					Usage: "Memory of the node in MiB. Overrides the flavor.",
+				},
+				cli.IntFlag{
+					Name:  "cpus",
+					Usage: "Number of virtual cpus. Overrides the flavor.",
+				},
+				cli.StringFlag{
+					Name:  "disk-size",
+					Usage: "Size of the disk, e.g. 40G. Overrides the flavor.",
+				},
+				cli.StringSliceFlag{
+					Name:  "user-data",
+					Usage: "cloud-init user-data template to merge into the defaults. Can be given multiple times.",
+				},
+				cli.StringSliceFlag{
+					Name:  "ssh-key",
+					Usage: "Authorized ssh key: a public key file, a literal key, agent: for all keys of the ssh agent or gh:<user> for the keys of a GitHub user. Can be given multiple times. Defaults to the keys in ~/.ssh.",
+				},
+				cli.StringSliceFlag{
+					Name:  "network",
+					Usage: "Network interface: network=<libvirt network>, bridge=<bridge>, macvtap=<host device> or none, each optionally followed by ,mac=<address>. Can be given multiple times. Defaults to bridge=bridge0 and network=default, or network=node-manager once it is created, if they exist.",
+				},
+				cli.StringSliceFlag{
+					Name:  "ip",
+					Usage: "Address of the n-th interface as <address>/<prefix>, dhcp or auto, which takes one from the address pool of its network in config.yaml. Can be given once per interface.",
+				},
+				cli.StringSliceFlag{
+					Name:  "gateway",
+					Usage: "Gateway of the n-th interface. Defaults to the one of its address pool.",
+				},
+				cli.StringSliceFlag{
+					Name:  "dns",
+					Usage: "Comma separated name servers of the n-th interface. Defaults to the ones of its address pool.",
+				},
+				cli.BoolFlag{
+					Name:  "password-auth",
+					Usage: "Allow ssh logins with the generated password. Only keys are accepted by default.",
+				},
+				cli.BoolFlag{
+					Name:  "wait, w",
+					Usage: "Wait until the node has booted and cloud-init has finished",
+				},
+				cli.DurationFlag{
+					Name:  "timeout, t",
+					Usage: "Time to wait for the node with --wait",
+					Value: 10 * time.Minute,
+				},
+			},
 		},
 		{
 			Name:   "rm",
 			Usage:  "remove node [ID's]",
 			Action: removeNodeCommand,
 		},
+		{
+			Name:      "start",
+			Usage:     "start nodes",
+			ArgsUsage: "[ID's]",
+			Action:    startNodesCommand,
+			Flags:     selectionFlags,
+		},
+		{
+			Name:      "stop",
+			Usage:     "shut nodes down, forcefully after a timeout",
+			ArgsUsage: "[ID's]",
+			Action:    stopNodesCommand,
+			Flags: append([]cli.Flag{
+				cli.DurationFlag{
+					Name:  "timeout, t",
+					Usage: "Time to wait for a graceful shutdown",
+					Value: time.Minute,
+				},
+			}, selectionFlags...),
+		},
+		{
+			Name:      "reboot",
+			Usage:     "reboot nodes",
+			ArgsUsage: "[ID's]",
+			Action:    rebootNodesCommand,
+			Flags:     selectionFlags,
+		},
+		{
+			Name:      "suspend",
+			Usage:     "pause nodes",
+			ArgsUsage: "[ID's]",
+			Action:    suspendNodesCommand,
+			Flags:     selectionFlags,
+		},
+		{
+			Name:      "resume",
+			Usage:     "resume paused nodes",
+			ArgsUsage: "[ID's]",
+			Action:    resumeNodesCommand,
+			Flags:     selectionFlags,
+		},
+		{
+			Name:      "ssh",
+			Usage:     "open a ssh session on a node",
+			ArgsUsage: "<ID> [-- ssh arguments]",
+			Action:    sshCommand,
+			Flags:     sshFlags,
+		},
+		{
+			Name:      "vnc",
+			Usage:     "print the VNC address of a node",
+			ArgsUsage: "<ID>",
+			Action:    vncCommand,
+			Flags: []cli.Flag{
+				cli.BoolFlag{
+					Name:  "open",
+					Usage: "Open the address with the default VNC viewer",
+				},
+			},
+		},
+		{
+			Name:      "console",
+			Usage:     "attach to the serial console of a node. Ctrl+] detaches.",
+			ArgsUsage: "<ID>",
+			Action:    consoleCommand,
+			Flags: []cli.Flag{
+				cli.BoolFlag{
+					Name:  "force, f",
+					Usage: "Take over the console if another client is attached to it",
+				},
+			},
+		},
+		{
+			Name:      "logs",
+			Usage:     "print the console log of a node",
+			ArgsUsage: "<ID>",
+			Action:    logsCommand,
+			Flags: []cli.Flag{
+				cli.BoolFlag{
+					Name:  "follow, f",
+					Usage: "Keep printing new output",
+				},
+				cli.IntFlag{
+					Name:  "lines, n",
+					Usage: "Only print this many trailing lines. 0 prints the whole log.",
+				},
+			},
+		},
+		{
+			Name:      "exec",
+			Usage:     "run a command on several nodes",
+			ArgsUsage: "<ID's|--all> -- <command>",
+			Action:    execCommand,
+			Flags:     append(append([]cli.Flag{}, sshFlags...), selectionFlags...),
+		},
+		{
+			Name:      "wait",
+			Usage:     "wait until nodes have booted and cloud-init has finished",
+			ArgsUsage: "[ID's]",
+			Action:    waitCommand,
+			Flags:     append(append([]cli.Flag{}, waitFlags...), selectionFlags...),
+		},
+		{
+			Name:      "credentials",
+			Usage:     "show the login user and password of a node",
+			ArgsUsage: "<ID>",
+			Action:    credentialsCommand,
+		},
 		{
 			Name:   "ls",
 			Usage:  "list nodes",
 			Action: listNodesCommand,
+			Flags: []cli.Flag{
+				cli.StringFlag{
+					Name:  "output, o",
+					Usage: "Output format: table, wide, json or yaml",
+					Value: "table",
+				},
+			},
+		},
+		{
+			Name:      "apply",
+			Usage:     "create, resize or remove nodes until they match a cluster file",
+			ArgsUsage: "<cluster.yaml|cluster.toml>",
+			Action:    applyCommand,
+			Flags: []cli.Flag{
+				cli.BoolFlag{
+					Name:  "dry-run",
+					Usage: "Only print the planned changes",
+				},
+				cli.BoolFlag{
+					Name:  "yes, y",
+					Usage: "Apply the changes without asking for confirmation",
+				},
+			},
+		},
+		{
+			Name:  "image",
+			Usage: "manage base images",
+			Subcommands: []cli.Command{
+				{
+					Name:   "ls",
+					Usage:  "list the images in the index and whether they are downloaded",
+					Action: listImagesCommand,
+					Flags: []cli.Flag{
+						cli.StringFlag{
+							Name:  "image",
+							Usage: "Only list images of this source",
+						},
+					},
+				},
+				{
+					Name:      "pull",
+					Usage:     "download images",
+					ArgsUsage: "<source>[:<version>]...",
+					Action:    pullImagesCommand,
+					Flags: []cli.Flag{
+						cli.BoolFlag{
+							Name:  "force, f",
+							Usage: "Download images again that are already present",
+						},
+						cli.BoolFlag{
+							Name:  "refresh",
+							Usage: "Download the index again",
+						},
+						mirrorFlag,
+						insecureFlag,
+						cli.IntFlag{
+							Name:  "jobs, j",
+							Usage: "Number of parallel downloads",
+							Value: 3,
+						},
+					},
+				},
+				{
+					Name:      "import",
+					Usage:     "add an image from local media",
+					ArgsUsage: "<file>",
+					Action:    importImageCommand,
+					Flags: []cli.Flag{
+						imageFlag,
+						cli.StringFlag{
+							Name:  "sha256",
+							Usage: "Checksum of the file as listed in the index, e.g. of the .qcow2.gz download. It is computed if missing.",
+						},
+						indexFileFlag,
+						insecureFlag,
+						cli.BoolFlag{
+							Name:  "force, f",
+							Usage: "Replace the image if it is already present",
+						},
+					},
+				},
+				{
+					Name:      "rm",
+					Usage:     "remove downloaded images",
+					ArgsUsage: "<source>:<version>...",
+					Action:    removeImagesCommand,
+				},
+				{
+					Name:   "prune",
+					Usage:  "remove all downloaded images that no node uses",
+					Action: pruneImagesCommand,
+					Flags: []cli.Flag{
+						cli.BoolFlag{
+							Name:  "dry-run",
+							Usage: "Only print the images that would be removed",
+						},
+					},
+				},
+			},
+		},
+		{
+			Name:  "network",
+			Usage: "manage the cluster network",
+			Subcommands: []cli.Command{
+				{
+					Name:   "create",
+					Usage:  "define the network node-manager, which gives every node a fixed address and resolves hostnames",
+					Action: createNetworkCommand,
+					Flags: []cli.Flag{
+						cli.StringFlag{
+							Name:  "subnet",
+							Usage: "Subnet of the network. Defaults to cluster-network.subnet in config.yaml or " + DEFAULT_CLUSTER_SUBNET + ".",
+						},
+						cli.StringFlag{
+							Name:  "dhcp-start",
+							Usage: "First address handed out to nodes. Defaults to the second host address of the subnet.",
+						},
+						cli.StringFlag{
+							Name:  "dhcp-end",
+							Usage: "Last address handed out to nodes. Defaults to the last host address of the subnet.",
+						},
+						cli.StringFlag{
+							Name:  "domain",
+							Usage: "DNS domain of the nodes, e.g. cluster.lan",
+						},
+						cli.BoolFlag{
+							Name:  "isolated",
+							Usage: "Do not route the network to the outside",
+						},
+					},
+				},
+				{
+					Name:   "rm",
+					Usage:  "remove the network node-manager",
+					Action: removeNetworkCommand,
+				},
+			},
 		},
-
 		{
 			Name:   "init",
 			Usage:  "initiaizes the node manager",
 			Action: initNodeManagerCommand,
 			Flags: []cli.Flag{
+				imageFlag,
 				cli.BoolFlag{
 					Name:  "force, f",
 					Usage: "Force the re initialization",
 				},
+				cli.StringSliceFlag{
+					Name:  "version",
+					Usage: "Version of the image to download. Can be given multiple times to prefetch several versions.",
+				},
+				cli.IntFlag{
+					Name:  "jobs, j",
+					Usage: "Number of parallel downloads",
+					Value: 3,
+				},
+				mirrorFlag,
+				indexFileFlag,
+				insecureFlag,
 			},
 		},
 	}
@@ -47,6 +385,21 @@ func main() {
 			Name:  "dir, d",
 			Usage: "Specify the working directory. Defaults to $PWD/kvm.",
 		},
+		cli.StringFlag{
+			Name:   "connect, c",
+			Usage:  "libvirt connection URI, e.g. qemu:///system or qemu+ssh://user@host/system",
+			EnvVar: "LIBVIRT_DEFAULT_URI",
+			Value:  "qemu:///session",
+		},
+		cli.StringFlag{
+			Name:  "pool",
+			Usage: "Storage pool for disks and seed images. It is created if it does not exist.",
+			Value: "node-manager",
+		},
+		cli.StringFlag{
+			Name:  "pool-path",
+			Usage: "Directory of a newly created storage pool. Defaults to <dir>/pool locally and /var/lib/libvirt/images/node-manager on remote hosts.",
+		},
 	}
 
 	err := app.Run(os.Args)
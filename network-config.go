@@ -0,0 +1,270 @@
+package main
+
+import (
+	"fmt"
+	"net"
+	"strings"
+
+	libvirt "github.com/libvirt/libvirt-go"
+	yaml "gopkg.in/yaml.v2"
+)
+
+// interfaceConfig is the addressing of one interface of a node. Interfaces
+// without address use DHCP.
+type interfaceConfig struct {
+	mac     string
+	address string
+	gateway string
+	dns     []string
+}
+
+// cloud-init network configuration version 2, which follows netplan
+type networkConfig struct {
+	Version   int                       `yaml:"version"`
+	Ethernets map[string]ethernetConfig `yaml:"ethernets"`
+}
+
+type ethernetConfig struct {
+	Match       map[string]string  `yaml:"match"`
+	DHCP4       bool               `yaml:"dhcp4"`
+	Addresses   []string           `yaml:"addresses,omitempty"`
+	Gateway4    string             `yaml:"gateway4,omitempty"`
+	Nameservers *nameserversConfig `yaml:"nameservers,omitempty"`
+}
+
+type nameserversConfig struct {
+	Addresses []string `yaml:"addresses"`
+}
+
+// configureAddresses decides on the addresses of the interfaces in networks.
+// The n-th entry of opts.addresses, opts.gateways and opts.dns belongs to
+// the n-th interface. An address is either <address>/<prefix>, dhcp or auto,
+// which takes the next free address of the matching pool in config.yaml.
+// Interfaces without address get one from their pool, if there is one.
+// As cloud-init finds interfaces by their mac address, all interfaces get
+// one if any of them is configured statically. The returned configs are
+// empty if all interfaces use DHCP.
+func configureAddresses(conn *libvirt.Connect, conf *config, networks []string, opts nodeOptions) ([]string, []interfaceConfig, error) {
+	ifaces := make([]*domainInterface, 0)
+	positions := make([]int, 0)
+	for i, network := range networks {
+		iface, err := parseNetwork(network)
+		if err != nil {
+			return nil, nil, err
+		}
+		if iface != nil {
+			ifaces = append(ifaces, iface)
+			positions = append(positions, i)
+		}
+	}
+	for flag, values := range map[string][]string{"ip": opts.addresses, "gateway": opts.gateways, "dns": opts.dns} {
+		if len(values) > len(ifaces) {
+			return nil, nil, fmt.Errorf("--%s is given %d times, but the node has only %d interfaces", flag, len(values), len(ifaces))
+		}
+	}
+
+	var used map[string]bool
+	configs := make([]interfaceConfig, len(ifaces))
+	static := false
+	for i, iface := range ifaces {
+		address := ""
+		if i < len(opts.addresses) {
+			address = opts.addresses[i]
+		}
+		pool := conf.addressPool(iface)
+		if iface.Type == "network" && iface.Source.Network == CLUSTER_NETWORK {
+			if address != "" && address != "dhcp" {
+				return nil, nil, fmt.Errorf("addresses in network %s are assigned by its DHCP server", CLUSTER_NETWORK)
+			}
+			pool = nil
+			address = "dhcp"
+		}
+		if address == "" && pool != nil {
+			address = "auto"
+		}
+
+		config := &configs[i]
+		if address != "" && address != "dhcp" {
+			if used == nil {
+				var err error
+				used, err = usedAddresses(conn)
+				if err != nil {
+					return nil, nil, err
+				}
+			}
+			var err error
+			config.address, err = chooseAddress(address, pool, used)
+			if err != nil {
+				return nil, nil, fmt.Errorf("interface %d: %s", i+1, err)
+			}
+			used[strings.Split(config.address, "/")[0]] = true
+			static = true
+			if pool != nil {
+				config.gateway = pool.Gateway
+				config.dns = pool.DNS
+			}
+		}
+
+		if i < len(opts.gateways) && opts.gateways[i] != "" {
+			config.gateway = opts.gateways[i]
+		}
+		if i < len(opts.dns) && opts.dns[i] != "" {
+			config.dns = strings.Split(opts.dns[i], ",")
+		}
+		if config.address == "" && (config.gateway != "" || len(config.dns) > 0) {
+			return nil, nil, fmt.Errorf("interface %d uses DHCP. --gateway and --dns need a static address", i+1)
+		}
+		for _, ip := range append([]string{config.gateway}, config.dns...) {
+			if ip != "" && net.ParseIP(ip) == nil {
+				return nil, nil, fmt.Errorf("interface %d: invalid address %s", i+1, ip)
+			}
+		}
+	}
+	if !static {
+		return networks, nil, nil
+	}
+
+	result := append([]string{}, networks...)
+	for i, iface := range ifaces {
+		if iface.MAC != nil {
+			configs[i].mac = iface.MAC.Address
+			continue
+		}
+		mac, err := randomMAC()
+		if err != nil {
+			return nil, nil, err
+		}
+		configs[i].mac = mac
+		result[positions[i]] = fmt.Sprintf("%s,mac=%s", networks[positions[i]], mac)
+	}
+	return result, configs, nil
+}
+
+// chooseAddress parses an address or, for auto, takes the next free one
+// from pool. The gateway is never handed out. A pool with neither start nor
+// gateway leaves out the first host address of its subnet, which is usually
+// taken by the host. Explicit addresses have to lie in the subnet of the
+// pool and must not be its gateway.
+func chooseAddress(address string, pool *addressPool, used map[string]bool) (string, error) {
+	var subnet *net.IPNet
+	if pool != nil {
+		var err error
+		_, subnet, err = net.ParseCIDR(pool.Subnet)
+		if err != nil || subnet.IP.To4() == nil {
+			return "", fmt.Errorf("address pool of %s has an invalid subnet %s", pool.Network, pool.Subnet)
+		}
+	}
+
+	if address != "auto" {
+		cidr := address
+		if !strings.Contains(address, "/") && subnet != nil {
+			prefix, _ := subnet.Mask.Size()
+			cidr = fmt.Sprintf("%s/%d", address, prefix)
+		}
+		ip, _, err := net.ParseCIDR(cidr)
+		if err != nil {
+			return "", fmt.Errorf("invalid address %s. Expected <address>/<prefix>, dhcp or auto", address)
+		}
+		if subnet != nil && !subnet.Contains(ip) {
+			return "", fmt.Errorf("address %s is not in the subnet %s of the address pool of %s", ip, subnet, pool.Network)
+		}
+		if pool != nil && ip.Equal(net.ParseIP(pool.Gateway)) {
+			return "", fmt.Errorf("address %s is the gateway of %s", ip, pool.Network)
+		}
+		if used[ip.String()] {
+			return "", fmt.Errorf("address %s is already used by another node", ip)
+		}
+		return cidr, nil
+	}
+
+	if pool == nil {
+		return "", fmt.Errorf("no address pool in config.yaml matches the network")
+	}
+	prefix, bits := subnet.Mask.Size()
+	start := ipToInt(subnet.IP) + 1
+	end := ipToInt(subnet.IP) | (1<<uint(bits-prefix) - 1) - 1
+	if pool.Gateway == "" {
+		start++
+	}
+	if pool.Start != "" {
+		ip := net.ParseIP(pool.Start).To4()
+		if ip == nil || !subnet.Contains(ip) {
+			return "", fmt.Errorf("address pool of %s has an invalid start %s", pool.Network, pool.Start)
+		}
+		start = ipToInt(ip)
+	}
+	if pool.End != "" {
+		ip := net.ParseIP(pool.End).To4()
+		if ip == nil || !subnet.Contains(ip) {
+			return "", fmt.Errorf("address pool of %s has an invalid end %s", pool.Network, pool.End)
+		}
+		end = ipToInt(ip)
+	}
+	for i := start; i <= end; i++ {
+		candidate := intToIP(i).String()
+		if !used[candidate] && candidate != pool.Gateway {
+			return fmt.Sprintf("%s/%d", candidate, prefix), nil
+		}
+	}
+	return "", fmt.Errorf("the address pool of %s is exhausted", pool.Network)
+}
+
+// usedAddresses collects the static addresses of all nodes.
+func usedAddresses(conn *libvirt.Connect) (map[string]bool, error) {
+	used := make(map[string]bool)
+	err := forEachNode(conn, func(dom *libvirt.Domain, name, nodeNumber string) error {
+		meta, err := getNodeMetadata(dom)
+		if err != nil {
+			return err
+		}
+		for _, address := range meta.Addresses {
+			used[strings.Split(address, "/")[0]] = true
+		}
+		return nil
+	})
+	return used, err
+}
+
+// addressPool returns the pool of the network of iface or nil.
+func (c *config) addressPool(iface *domainInterface) *addressPool {
+	for i, pool := range c.AddressPools {
+		candidate, err := parseNetwork(pool.Network)
+		if err == nil && candidate != nil && candidate.Type == iface.Type && candidate.Source == iface.Source {
+			return &c.AddressPools[i]
+		}
+	}
+	return nil
+}
+
+// renderNetworkConfig writes the network-config of the NoCloud seed.
+func renderNetworkConfig(configs []interfaceConfig) (string, error) {
+	conf := networkConfig{Version: 2, Ethernets: make(map[string]ethernetConfig)}
+	for i, iface := range configs {
+		ethernet := ethernetConfig{
+			Match:    map[string]string{"macaddress": iface.mac},
+			DHCP4:    iface.address == "",
+			Gateway4: iface.gateway,
+		}
+		if iface.address != "" {
+			ethernet.Addresses = []string{iface.address}
+		}
+		if len(iface.dns) > 0 {
+			ethernet.Nameservers = &nameserversConfig{Addresses: iface.dns}
+		}
+		conf.Ethernets[fmt.Sprintf("nic%d", i)] = ethernet
+	}
+	raw, err := yaml.Marshal(conf)
+	return string(raw), err
+}
+
+// staticAddresses lists the addresses of configs that are not assigned by
+// DHCP.
+func staticAddresses(configs []interfaceConfig) []string {
+	addresses := make([]string, 0)
+	for _, iface := range configs {
+		if iface.address != "" {
+			addresses = append(addresses, iface.address)
+		}
+	}
+	return addresses
+}
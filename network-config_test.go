@@ -0,0 +1,114 @@
+package main
+
+import (
+	"strings"
+	"testing"
+
+	yaml "gopkg.in/yaml.v2"
+)
+
+func TestChooseAddress(t *testing.T) {
+	pool := &addressPool{Network: "bridge=br0", Subnet: "10.0.0.0/24", Gateway: "10.0.0.1"}
+	noGateway := &addressPool{Network: "bridge=br0", Subnet: "10.0.0.0/24"}
+	bounded := &addressPool{Network: "bridge=br0", Subnet: "10.0.0.0/24", Start: "10.0.0.100", End: "10.0.0.102", Gateway: "10.0.0.101"}
+	small := &addressPool{Network: "bridge=br0", Subnet: "10.0.0.0/30", Gateway: "10.0.0.2"}
+	cases := []struct {
+		name     string
+		address  string
+		pool     *addressPool
+		used     []string
+		expected string
+		message  string
+	}{
+		{"first free address", "auto", pool, nil, "10.0.0.2/24", ""},
+		{"skips used addresses", "auto", pool, []string{"10.0.0.2", "10.0.0.3"}, "10.0.0.4/24", ""},
+		{"skips the host without gateway", "auto", noGateway, nil, "10.0.0.2/24", ""},
+		{"gateway in the middle", "auto", &addressPool{Network: "bridge=br0", Subnet: "10.0.0.0/24", Gateway: "10.0.0.2"}, nil, "10.0.0.1/24", ""},
+		{"pool start", "auto", bounded, nil, "10.0.0.100/24", ""},
+		{"skips the gateway", "auto", bounded, []string{"10.0.0.100"}, "10.0.0.102/24", ""},
+		{"pool end", "auto", bounded, []string{"10.0.0.100", "10.0.0.102"}, "", "exhausted"},
+		{"last host address", "auto", small, []string{"10.0.0.1"}, "", "exhausted"},
+		{"small subnet", "auto", small, nil, "10.0.0.1/30", ""},
+		{"no pool", "auto", nil, nil, "", "no address pool"},
+		{"invalid start", "auto", &addressPool{Network: "bridge=br0", Subnet: "10.0.0.0/24", Start: "10.0.1.1"}, nil, "", "invalid start"},
+		{"invalid end", "auto", &addressPool{Network: "bridge=br0", Subnet: "10.0.0.0/24", End: "end"}, nil, "", "invalid end"},
+		{"invalid subnet", "auto", &addressPool{Network: "bridge=br0", Subnet: "fd00::/64"}, nil, "", "invalid subnet"},
+		{"explicit address", "10.0.0.50/24", pool, nil, "10.0.0.50/24", ""},
+		{"explicit address without pool", "192.168.1.5/16", nil, nil, "192.168.1.5/16", ""},
+		{"takes the prefix of the pool", "10.0.0.50", pool, nil, "10.0.0.50/24", ""},
+		{"explicit address outside the pool range", "10.0.0.200", bounded, nil, "10.0.0.200/24", ""},
+		{"explicit address in use", "10.0.0.50/24", pool, []string{"10.0.0.50"}, "", "already used"},
+		{"prefix-less address in use", "10.0.0.50", pool, []string{"10.0.0.50"}, "", "already used"},
+		{"explicit gateway", "10.0.0.1", pool, nil, "", "is the gateway"},
+		{"explicit address outside the subnet", "10.0.1.50/24", pool, nil, "", "not in the subnet"},
+		{"no prefix without pool", "10.0.0.50", nil, nil, "", "invalid address"},
+		{"invalid address", "node", pool, nil, "", "invalid address"},
+	}
+	for _, c := range cases {
+		used := make(map[string]bool)
+		for _, address := range c.used {
+			used[address] = true
+		}
+		address, err := chooseAddress(c.address, c.pool, used)
+		if c.message != "" {
+			if err == nil || !strings.Contains(err.Error(), c.message) {
+				t.Errorf("%s: got %q, %v, expected an error about %s", c.name, address, err, c.message)
+			}
+			continue
+		}
+		if err != nil || address != c.expected {
+			t.Errorf("%s: got %q, %v, expected %s", c.name, address, err, c.expected)
+		}
+	}
+}
+
+func TestRenderNetworkConfig(t *testing.T) {
+	configs := []interfaceConfig{
+		{mac: "52:54:00:00:00:01", address: "10.0.0.2/24", gateway: "10.0.0.1", dns: []string{"10.0.0.1", "9.9.9.9"}},
+		{mac: "52:54:00:00:00:02"},
+		{mac: "52:54:00:00:00:03", address: "192.168.1.5/16"},
+	}
+	out, err := renderNetworkConfig(configs)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// unquoted, YAML 1.1 would read mac addresses as sexagesimal numbers
+	parsed := networkConfig{}
+	err = yaml.Unmarshal([]byte(out), &parsed)
+	if err != nil {
+		t.Fatalf("invalid yaml: %s\n%s", err, out)
+	}
+	for i, name := range []string{"nic0", "nic1", "nic2"} {
+		if mac := parsed.Ethernets[name].Match["macaddress"]; mac != configs[i].mac {
+			t.Errorf("%s matches %q instead of %s", name, mac, configs[i].mac)
+		}
+	}
+	expected := `version: 2
+ethernets:
+  nic0:
+    match:
+      macaddress: "52:54:00:00:00:01"
+    dhcp4: false
+    addresses:
+    - 10.0.0.2/24
+    gateway4: 10.0.0.1
+    nameservers:
+      addresses:
+      - 10.0.0.1
+      - 9.9.9.9
+  nic1:
+    match:
+      macaddress: "52:54:00:00:00:02"
+    dhcp4: true
+  nic2:
+    match:
+      macaddress: "52:54:00:00:00:03"
+    dhcp4: false
+    addresses:
+    - 192.168.1.5/16
+`
+	if out != expected {
+		t.Errorf("got\n%s\nexpected\n%s", out, expected)
+	}
+}
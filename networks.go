@@ -0,0 +1,125 @@
+package main
+
+import (
+	"fmt"
+	"net"
+
+	libvirt "github.com/libvirt/libvirt-go"
+)
+
+// DEFAULT_NETWORKS are attached to nodes that do not ask for networks. The
+// ones missing on the host are left out. The cluster network takes the place
+// of the default network once it has been created.
+var DEFAULT_NETWORKS = []string{"bridge=bridge0", "network=default"}
+
+// resolveNetworks checks that the libvirt networks, bridges and devices
+// that networks refer to exist, before anything of a node is created.
+// Without networks, the available default networks are returned.
+func resolveNetworks(conn *libvirt.Connect, networks []string) ([]string, error) {
+	if len(networks) == 0 {
+		defaults := DEFAULT_NETWORKS
+		if network, err := conn.LookupNetworkByName(CLUSTER_NETWORK); err == nil {
+			network.Free()
+			defaults = []string{"bridge=bridge0", "network=" + CLUSTER_NETWORK}
+		}
+		available := make([]string, 0)
+		for _, network := range defaults {
+			err := checkNetwork(conn, network)
+			if err != nil {
+				fmt.Printf("skipping default network %s: %s\n", network, err)
+				continue
+			}
+			available = append(available, network)
+		}
+		if len(available) == 0 {
+			return nil, fmt.Errorf("none of the default networks %v exist. Pass --network", defaults)
+		}
+		return available, nil
+	}
+
+	if stringInSlice("none", networks) {
+		if len(networks) > 1 {
+			return nil, fmt.Errorf("network none can not be combined with other networks")
+		}
+		return networks, nil
+	}
+	macs := make([]string, 0)
+	for _, network := range networks {
+		iface, err := parseNetwork(network)
+		if err != nil {
+			return nil, err
+		}
+		if iface.MAC != nil {
+			if stringInSlice(iface.MAC.Address, macs) {
+				return nil, fmt.Errorf("mac address %s is used more than once", iface.MAC.Address)
+			}
+			macs = append(macs, iface.MAC.Address)
+		}
+		err = checkNetwork(conn, network)
+		if err != nil {
+			return nil, fmt.Errorf("network %s: %s", network, err)
+		}
+	}
+	return networks, nil
+}
+
+func checkNetwork(conn *libvirt.Connect, network string) error {
+	iface, err := parseNetwork(network)
+	if err != nil || iface == nil {
+		return err
+	}
+	switch iface.Type {
+	case "network":
+		libvirtNet, err := conn.LookupNetworkByName(iface.Source.Network)
+		if err != nil {
+			return fmt.Errorf("libvirt network %s not found", iface.Source.Network)
+		}
+		defer libvirtNet.Free()
+		active, err := libvirtNet.IsActive()
+		if err != nil {
+			return err
+		}
+		if !active {
+			return fmt.Errorf("libvirt network %s is not active. Start it with virsh net-start %s", iface.Source.Network, iface.Source.Network)
+		}
+	case "bridge":
+		return checkHostInterface(conn, iface.Source.Bridge)
+	case "direct":
+		return checkHostInterface(conn, iface.Source.Dev)
+	}
+	return nil
+}
+
+// checkHostInterface looks for a network interface of the hypervisor host.
+// Local interfaces are looked up directly, as libvirt can not list them on
+// qemu:///session. Remote hosts whose interfaces libvirt can not list are
+// not checked.
+func checkHostInterface(conn *libvirt.Connect, name string) error {
+	remote, err := isRemoteConnection(conn)
+	if err != nil {
+		return err
+	}
+	if !remote {
+		_, err := net.InterfaceByName(name)
+		if err != nil {
+			return fmt.Errorf("host interface %s not found", name)
+		}
+		return nil
+	}
+
+	ifaces, err := conn.ListAllInterfaces(0)
+	if err != nil {
+		fmt.Printf("not checking host interface %s, libvirt can not list the interfaces of the host: %s\n", name, err)
+		return nil
+	}
+	found := false
+	for _, iface := range ifaces {
+		ifaceName, err := iface.GetName()
+		found = found || (err == nil && ifaceName == name)
+		iface.Free()
+	}
+	if !found {
+		return fmt.Errorf("host interface %s not found", name)
+	}
+	return nil
+}
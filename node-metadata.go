@@ -0,0 +1,47 @@
+package main
+
+import (
+	"encoding/xml"
+
+	libvirt "github.com/libvirt/libvirt-go"
+)
+
+const METADATA_URI = "https://github.com/Richterrettich/node-manager"
+const METADATA_PREFIX = "node-manager"
+
+type nodeMetadata struct {
+	XMLName xml.Name `xml:"node"`
+	Group   string   `xml:"group,omitempty"`
+	Flavor  string   `xml:"flavor,omitempty"`
+	Image   string   `xml:"image,omitempty"`
+	User    string   `xml:"user,omitempty"`
+	// Ignition is set for nodes provisioned with Ignition instead of
+	// cloud-init
+	Ignition bool `xml:"ignition,omitempty"`
+	// Addresses are the static addresses of the node
+	Addresses []string `xml:"address"`
+}
+
+func getNodeMetadata(dom *libvirt.Domain) (*nodeMetadata, error) {
+	meta := &nodeMetadata{}
+	raw, err := dom.GetMetadata(libvirt.DOMAIN_METADATA_ELEMENT, METADATA_URI, libvirt.DOMAIN_AFFECT_CONFIG)
+	if err != nil {
+		if lverr, ok := err.(libvirt.Error); ok && lverr.Code == libvirt.ERR_NO_DOMAIN_METADATA {
+			return meta, nil
+		}
+		return nil, err
+	}
+	err = xml.Unmarshal([]byte(raw), meta)
+	if err != nil {
+		return nil, err
+	}
+	return meta, nil
+}
+
+func setNodeMetadata(dom *libvirt.Domain, meta *nodeMetadata) error {
+	raw, err := xml.Marshal(meta)
+	if err != nil {
+		return err
+	}
+	return dom.SetMetadata(libvirt.DOMAIN_METADATA_ELEMENT, string(raw), METADATA_PREFIX, METADATA_URI, libvirt.DOMAIN_AFFECT_CONFIG)
+}
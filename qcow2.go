@@ -0,0 +1,103 @@
+package main
+
+import (
+	"encoding/binary"
+	"fmt"
+	"os"
+)
+
+const QCOW2_MAGIC = 0x514649fb
+
+const (
+	qcow2ClusterBits      = 16
+	qcow2ClusterSize      = 1 << qcow2ClusterBits
+	qcow2HeaderLength     = 104
+	qcow2BackingFormatExt = 0xe2792aca
+)
+
+// qcow2VirtualSize reads the size of the virtual disk from a qcow2 header.
+func qcow2VirtualSize(path string) (uint64, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return 0, err
+	}
+	defer f.Close()
+
+	header := make([]byte, 32)
+	_, err = f.ReadAt(header, 0)
+	if err != nil {
+		return 0, err
+	}
+	if binary.BigEndian.Uint32(header[0:4]) != QCOW2_MAGIC {
+		return 0, fmt.Errorf("%s is not a qcow2 image", path)
+	}
+	return binary.BigEndian.Uint64(header[24:32]), nil
+}
+
+// probeImage returns the format and the virtual size of a disk image. Files
+// without a qcow2 header are treated as raw images.
+func probeImage(path string) (string, uint64, error) {
+	size, err := qcow2VirtualSize(path)
+	if err == nil {
+		return "qcow2", size, nil
+	}
+	info, statErr := os.Stat(path)
+	if statErr != nil {
+		return "", 0, statErr
+	}
+	return "raw", uint64(info.Size()), nil
+}
+
+// qcow2Overlay renders an empty qcow2 version 3 image. Its layout is one
+// cluster each for the header, the refcount table and the only refcount
+// block, followed by the zeroed L1 table. Everything else is allocated by
+// qemu on demand.
+func qcow2Overlay(backingPath, backingFormat string, size uint64) ([]byte, error) {
+	l2Coverage := uint64(qcow2ClusterSize/8) * qcow2ClusterSize
+	l1Size := (size + l2Coverage - 1) / l2Coverage
+	l1Clusters := (l1Size*8 + qcow2ClusterSize - 1) / qcow2ClusterSize
+	if l1Clusters == 0 {
+		l1Clusters = 1
+	}
+	totalClusters := 3 + l1Clusters
+	if totalClusters > qcow2ClusterSize/2 {
+		return nil, fmt.Errorf("virtual size %d is too large", size)
+	}
+
+	image := make([]byte, totalClusters*qcow2ClusterSize)
+	header := image[:qcow2ClusterSize]
+	binary.BigEndian.PutUint32(header[0:], QCOW2_MAGIC)
+	binary.BigEndian.PutUint32(header[4:], 3)
+	binary.BigEndian.PutUint32(header[20:], qcow2ClusterBits)
+	binary.BigEndian.PutUint64(header[24:], size)
+	binary.BigEndian.PutUint32(header[36:], uint32(l1Size))
+	binary.BigEndian.PutUint64(header[40:], 3*qcow2ClusterSize)
+	binary.BigEndian.PutUint64(header[48:], 1*qcow2ClusterSize)
+	binary.BigEndian.PutUint32(header[56:], 1)
+	binary.BigEndian.PutUint32(header[96:], 4)
+	binary.BigEndian.PutUint32(header[100:], qcow2HeaderLength)
+
+	offset := qcow2HeaderLength
+	binary.BigEndian.PutUint32(header[offset:], qcow2BackingFormatExt)
+	binary.BigEndian.PutUint32(header[offset+4:], uint32(len(backingFormat)))
+	copy(header[offset+8:], backingFormat)
+	offset += 8 + (len(backingFormat)+7)/8*8
+	// end of header extensions
+	offset += 8
+
+	if offset+len(backingPath) > qcow2ClusterSize {
+		return nil, fmt.Errorf("backing file path %s is too long", backingPath)
+	}
+	binary.BigEndian.PutUint64(header[8:], uint64(offset))
+	binary.BigEndian.PutUint32(header[16:], uint32(len(backingPath)))
+	copy(header[offset:], backingPath)
+
+	refcountTable := image[qcow2ClusterSize : 2*qcow2ClusterSize]
+	binary.BigEndian.PutUint64(refcountTable, 2*qcow2ClusterSize)
+
+	refcountBlock := image[2*qcow2ClusterSize : 3*qcow2ClusterSize]
+	for cluster := uint64(0); cluster < totalClusters; cluster++ {
+		binary.BigEndian.PutUint16(refcountBlock[cluster*2:], 1)
+	}
+	return image, nil
+}
@@ -0,0 +1,139 @@
+package main
+
+import (
+	"encoding/binary"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestQcow2Overlay(t *testing.T) {
+	cases := []struct {
+		size       uint64
+		l1Size     uint32
+		l1Clusters uint64
+	}{
+		{1, 1, 1},
+		{10 << 30, 20, 1},
+		{5 << 40, 10240, 2},
+	}
+	for _, c := range cases {
+		image, err := qcow2Overlay("/pool/base.qcow2", "qcow2", c.size)
+		if err != nil {
+			t.Fatal(err)
+		}
+		totalClusters := 3 + c.l1Clusters
+		if uint64(len(image)) != totalClusters*qcow2ClusterSize {
+			t.Errorf("size %d: image has %d bytes, expected %d clusters", c.size, len(image), totalClusters)
+		}
+
+		header := image[:qcow2ClusterSize]
+		be32 := func(offset int) uint32 { return binary.BigEndian.Uint32(header[offset:]) }
+		be64 := func(offset int) uint64 { return binary.BigEndian.Uint64(header[offset:]) }
+		expected := []struct {
+			field  string
+			actual uint64
+			value  uint64
+		}{
+			{"magic", uint64(be32(0)), QCOW2_MAGIC},
+			{"version", uint64(be32(4)), 3},
+			{"cluster bits", uint64(be32(20)), qcow2ClusterBits},
+			{"size", be64(24), c.size},
+			{"crypt method", uint64(be32(32)), 0},
+			{"l1 size", uint64(be32(36)), uint64(c.l1Size)},
+			{"l1 table offset", be64(40), 3 * qcow2ClusterSize},
+			{"refcount table offset", be64(48), qcow2ClusterSize},
+			{"refcount table clusters", uint64(be32(56)), 1},
+			{"snapshots", uint64(be32(60)), 0},
+			{"incompatible features", be64(72), 0},
+			{"refcount order", uint64(be32(96)), 4},
+			{"header length", uint64(be32(100)), qcow2HeaderLength},
+		}
+		for _, e := range expected {
+			if e.actual != e.value {
+				t.Errorf("size %d: %s is %d, expected %d", c.size, e.field, e.actual, e.value)
+			}
+		}
+
+		// the backing format extension follows the header
+		if be32(qcow2HeaderLength) != qcow2BackingFormatExt || be32(qcow2HeaderLength+4) != 5 ||
+			string(header[qcow2HeaderLength+8:qcow2HeaderLength+13]) != "qcow2" {
+			t.Errorf("size %d: invalid backing format extension", c.size)
+		}
+		end := qcow2HeaderLength + 16
+		if be32(end) != 0 || be32(end+4) != 0 {
+			t.Errorf("size %d: header extensions are not terminated", c.size)
+		}
+		backingOffset, backingLength := be64(8), be32(16)
+		if backingOffset != uint64(end+8) || string(header[backingOffset:backingOffset+uint64(backingLength)]) != "/pool/base.qcow2" {
+			t.Errorf("size %d: backing file is %q at %d", c.size, header[backingOffset:backingOffset+uint64(backingLength)], backingOffset)
+		}
+
+		refcountTable := image[qcow2ClusterSize:]
+		if binary.BigEndian.Uint64(refcountTable) != 2*qcow2ClusterSize {
+			t.Errorf("size %d: refcount table does not point to the refcount block", c.size)
+		}
+		refcountBlock := image[2*qcow2ClusterSize:]
+		for cluster := uint64(0); cluster <= totalClusters; cluster++ {
+			expected := uint16(1)
+			if cluster == totalClusters {
+				expected = 0
+			}
+			if refcount := binary.BigEndian.Uint16(refcountBlock[cluster*2:]); refcount != expected {
+				t.Errorf("size %d: cluster %d has refcount %d, expected %d", c.size, cluster, refcount, expected)
+			}
+		}
+		for _, b := range image[3*qcow2ClusterSize:] {
+			if b != 0 {
+				t.Errorf("size %d: the L1 table is not empty", c.size)
+				break
+			}
+		}
+	}
+}
+
+func TestQcow2OverlayRejectsLongBackingPath(t *testing.T) {
+	_, err := qcow2Overlay("/"+strings.Repeat("x", qcow2ClusterSize), "qcow2", 10<<30)
+	if err == nil {
+		t.Error("a backing path longer than the header cluster was accepted")
+	}
+}
+
+func TestQcow2OverlayChecks(t *testing.T) {
+	dir, err := ioutil.TempDir("", "node-manager")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	base := filepath.Join(dir, "base.raw")
+	err = ioutil.WriteFile(base, make([]byte, 1<<20), 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	overlay, err := qcow2Overlay(base, "raw", 10<<30)
+	if err != nil {
+		t.Fatal(err)
+	}
+	path := filepath.Join(dir, "overlay.qcow2")
+	err = ioutil.WriteFile(path, overlay, 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	format, size, err := probeImage(path)
+	if err != nil || format != "qcow2" || size != 10<<30 {
+		t.Errorf("probed %s of %d bytes: %v", format, size, err)
+	}
+
+	qemuImg, err := exec.LookPath("qemu-img")
+	if err != nil {
+		t.Skip("qemu-img is not installed")
+	}
+	out, err := exec.Command(qemuImg, "check", path).CombinedOutput()
+	if err != nil {
+		t.Errorf("qemu-img check failed: %s\n%s", err, out)
+	}
+}
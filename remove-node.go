@@ -13,7 +13,7 @@ func removeNodeCommand(c *cli.Context) error {
 	argsPresent := c.Args().Present()
 	workingDirectory := getProjectDir(c)
 
-	conn, err := libvirt.NewConnect("qemu:///session")
+	conn, err := connect(c)
 
 	if err != nil {
 		log.Fatal(err)
@@ -24,11 +24,9 @@ func removeNodeCommand(c *cli.Context) error {
 		return removeAllNodes(workingDirectory, conn)
 	}
 
-	i := 0
-	arg := c.Args().Get(i)
-	nodeNumbers := make(map[string]bool)
-	for arg != "" {
-		nodeNumbers[arg] = true
+	nodeNumbers, err := selectedNodes(c)
+	if err != nil {
+		return err
 	}
 	return removeNodes(conn, workingDirectory, nodeNumbers)
 }
@@ -38,11 +36,16 @@ func removeNodes(conn *libvirt.Connect, workDir string, nodeNumbers map[string]b
 		if _, ok := nodeNumbers[nodeNumber]; !ok {
 			return nil
 		}
-		return removeNode(dom, name, workDir)
+		return removeNode(conn, dom, name, workDir)
 	})
 }
 
-func removeNode(dom *libvirt.Domain, name, workDir string) error {
+func removeNode(conn *libvirt.Connect, dom *libvirt.Domain, name, workDir string) error {
+	disks, err := domainDiskPaths(dom)
+	if err != nil {
+		return err
+	}
+
 	active, err := dom.IsActive()
 	if err != nil {
 		return err
@@ -54,17 +57,26 @@ func removeNode(dom *libvirt.Domain, name, workDir string) error {
 		}
 	}
 
+	err = releaseNodeAddresses(conn, dom)
+	if err != nil {
+		return err
+	}
+
 	fmt.Printf("undefining %s\n", name)
 	err = dom.UndefineFlags(libvirt.DOMAIN_UNDEFINE_MANAGED_SAVE)
 	if err != nil {
 		return err
 	}
+	err = deleteVolumes(conn, disks)
+	if err != nil {
+		return err
+	}
 	nodePath := fmt.Sprintf("%s/images/%s", workDir, name)
 	return os.RemoveAll(nodePath)
 }
 
 func removeAllNodes(workingDirectory string, conn *libvirt.Connect) error {
 	return forEachNode(conn, func(dom *libvirt.Domain, name, nodeNumber string) error {
-		return removeNode(dom, name, workingDirectory)
+		return removeNode(conn, dom, name, workingDirectory)
 	})
 }
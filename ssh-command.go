@@ -0,0 +1,253 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"os"
+	"os/exec"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+
+	libvirt "github.com/libvirt/libvirt-go"
+	"github.com/urfave/cli"
+)
+
+var sshFlags = []cli.Flag{
+	cli.StringFlag{
+		Name:  "user, u",
+		Usage: "Login user. Defaults to the default user of the node's base image.",
+	},
+	cli.DurationFlag{
+		Name:  "timeout, t",
+		Usage: "Time to wait for the node to become reachable",
+		Value: 2 * time.Minute,
+	},
+}
+
+func sshCommand(c *cli.Context) error {
+	id, extraArgs := splitAtTerminator(c.Args())
+	if len(id) != 1 {
+		return fmt.Errorf("expected exactly one node id")
+	}
+
+	conn, err := connect(c)
+	if err != nil {
+		log.Fatal(err)
+	}
+	defer conn.Close()
+
+	dom, err := lookupNode(conn, id[0])
+	if err != nil {
+		return err
+	}
+	defer dom.Free()
+
+	target, err := sshTarget(dom, getProjectDir(c), c.String("user"), c.Duration("timeout"))
+	if err != nil {
+		return err
+	}
+
+	sshPath, err := exec.LookPath("ssh")
+	if err != nil {
+		return err
+	}
+	args := append([]string{"ssh"}, sshArgs(target)...)
+	args = append(args, extraArgs...)
+	return syscall.Exec(sshPath, args, os.Environ())
+}
+
+func execCommand(c *cli.Context) error {
+	ids, command := splitAtTerminator(c.Args())
+	if c.Bool("all") {
+		if command == nil {
+			command = ids
+		}
+		ids = nil
+	} else if len(ids) == 0 {
+		return fmt.Errorf("no nodes given. Pass node ids or --all")
+	}
+	if len(command) == 0 {
+		return fmt.Errorf("no command given. Usage: node-manager exec <ID's|--all> -- <command>")
+	}
+
+	var nodeNumbers map[string]bool
+	if ids != nil {
+		nodeNumbers = make(map[string]bool)
+		for _, id := range ids {
+			nodeNumbers[strings.TrimPrefix(id, "atomic-host")] = true
+		}
+	}
+
+	conn, err := connect(c)
+	if err != nil {
+		log.Fatal(err)
+	}
+	defer conn.Close()
+
+	workDir := getProjectDir(c)
+	user := c.String("user")
+	timeout := c.Duration("timeout")
+	var outputLock sync.Mutex
+	return forNodesInParallel(conn, nodeNumbers, "done", func(dom *libvirt.Domain, name string) error {
+		target, err := sshTarget(dom, workDir, user, timeout)
+		if err != nil {
+			return err
+		}
+		stdout := &prefixWriter{prefix: name + " | ", out: os.Stdout, lock: &outputLock}
+		stderr := &prefixWriter{prefix: name + " | ", out: os.Stderr, lock: &outputLock}
+		defer stdout.Flush()
+		defer stderr.Flush()
+
+		cmd := exec.Command("ssh", append(append(sshArgs(target), "--"), command...)...)
+		cmd.Stdout = stdout
+		cmd.Stderr = stderr
+		return cmd.Run()
+	})
+}
+
+// splitAtTerminator splits arguments at the first "--". Without a
+// terminator, all arguments end up in the first part.
+func splitAtTerminator(args []string) ([]string, []string) {
+	for i, arg := range args {
+		if arg == "--" {
+			return args[:i], args[i+1:]
+		}
+	}
+	return args, nil
+}
+
+func lookupNode(conn *libvirt.Connect, id string) (*libvirt.Domain, error) {
+	name := "atomic-host" + strings.TrimPrefix(id, "atomic-host")
+	dom, err := conn.LookupDomainByName(name)
+	if err != nil {
+		return nil, fmt.Errorf("node %s not found", id)
+	}
+	return dom, nil
+}
+
+// sshTarget waits until the node has an address with an open ssh port and
+// returns it as user@address. Without user, the user recorded for the node
+// is taken or, for nodes that have none recorded, the default user of the
+// source of their base image.
+func sshTarget(dom *libvirt.Domain, workDir, user string, timeout time.Duration) (string, error) {
+	if user == "" {
+		meta, err := getNodeMetadata(dom)
+		if err != nil {
+			return "", err
+		}
+		user = meta.User
+		if user == "" {
+			ref, err := parseImageRef(meta.Image)
+			if err != nil {
+				return "", err
+			}
+			src, err := lookupImageSource(workDir, ref.source)
+			if err != nil {
+				return "", err
+			}
+			user = src.defaultUser()
+		}
+	}
+
+	deadline := time.Now().Add(timeout)
+	address, err := waitForAddress(dom, deadline)
+	if err != nil {
+		return "", err
+	}
+	err = waitForPort(address, 22, deadline)
+	if err != nil {
+		return "", err
+	}
+	return fmt.Sprintf("%s@%s", user, address), nil
+}
+
+// waitForAddress polls until the node reports an IP address. IPv4
+// addresses are preferred.
+func waitForAddress(dom *libvirt.Domain, deadline time.Time) (string, error) {
+	for {
+		addresses := nodeAddresses(dom)
+		for _, address := range addresses {
+			if !strings.Contains(address, ":") {
+				return address, nil
+			}
+		}
+		if len(addresses) > 0 {
+			return addresses[0], nil
+		}
+		if time.Now().After(deadline) {
+			return "", fmt.Errorf("timed out waiting for an IP address")
+		}
+		time.Sleep(2 * time.Second)
+	}
+}
+
+func waitForPort(address string, port int, deadline time.Time) error {
+	hostPort := net.JoinHostPort(address, fmt.Sprintf("%d", port))
+	for {
+		conn, err := net.DialTimeout("tcp", hostPort, 5*time.Second)
+		if err == nil {
+			conn.Close()
+			return nil
+		}
+		if time.Now().After(deadline) {
+			return fmt.Errorf("timed out waiting for %s: %s", hostPort, err)
+		}
+		time.Sleep(2 * time.Second)
+	}
+}
+
+// sshArgs skips host key verification. Nodes are recreated all the time and
+// reuse addresses, so their host keys would never match.
+func sshArgs(target string) []string {
+	return []string{
+		"-o", "StrictHostKeyChecking=no",
+		"-o", "UserKnownHostsFile=/dev/null",
+		"-o", "LogLevel=ERROR",
+		target,
+	}
+}
+
+// prefixWriter prefixes every line written to out. Lines of concurrent
+// writers sharing lock do not interleave.
+type prefixWriter struct {
+	prefix string
+	out    io.Writer
+	lock   *sync.Mutex
+	buf    []byte
+}
+
+func (w *prefixWriter) Write(data []byte) (int, error) {
+	w.buf = append(w.buf, data...)
+	for {
+		i := bytes.IndexByte(w.buf, '\n')
+		if i < 0 {
+			return len(data), nil
+		}
+		err := w.writeLine(w.buf[:i+1])
+		w.buf = w.buf[i+1:]
+		if err != nil {
+			return len(data), err
+		}
+	}
+}
+
+func (w *prefixWriter) Flush() error {
+	if len(w.buf) == 0 {
+		return nil
+	}
+	err := w.writeLine(append(w.buf, '\n'))
+	w.buf = nil
+	return err
+}
+
+func (w *prefixWriter) writeLine(line []byte) error {
+	w.lock.Lock()
+	defer w.lock.Unlock()
+	_, err := fmt.Fprintf(w.out, "%s%s", w.prefix, line)
+	return err
+}
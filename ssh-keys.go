@@ -0,0 +1,180 @@
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"os/exec"
+	"os/user"
+	"path/filepath"
+	"strings"
+)
+
+// GITHUB_KEYS_URL serves the public keys of a GitHub user.
+var GITHUB_KEYS_URL = "https://github.com/%s.keys"
+
+// DEFAULT_SSH_KEY_FILES are looked up in ~/.ssh when no key is given.
+var DEFAULT_SSH_KEY_FILES = []string{"id_ed25519.pub", "id_ecdsa.pub", "id_rsa.pub"}
+
+// collectSSHKeys resolves the key sources in specs into public keys. A
+// source is a public key file, a literal key, agent: for all identities of
+// the ssh agent or gh:<user> for the keys of a GitHub user. Without sources
+// the default key files in ~/.ssh are used. Nodes without a key would only
+// be reachable by password, so finding no key is an error.
+func collectSSHKeys(workDir string, specs []string) ([]string, error) {
+	var keys []string
+	var err error
+	if len(specs) == 0 {
+		keys, err = defaultSSHKeys()
+		if err != nil {
+			return nil, err
+		}
+	}
+	for _, spec := range specs {
+		var found []string
+		switch {
+		case spec == "agent:":
+			found, err = agentSSHKeys()
+		case strings.HasPrefix(spec, "gh:"):
+			found, err = githubSSHKeys(workDir, strings.TrimPrefix(spec, "gh:"))
+		case isSSHKey(spec):
+			found = []string{strings.TrimSpace(spec)}
+		default:
+			found, err = readSSHKeyFile(spec)
+		}
+		if err != nil {
+			return nil, fmt.Errorf("ssh key %s: %s", spec, err)
+		}
+		if len(found) == 0 {
+			return nil, fmt.Errorf("ssh key %s: no keys found", spec)
+		}
+		keys = append(keys, found...)
+	}
+
+	unique := make([]string, 0, len(keys))
+	for _, key := range keys {
+		if !stringInSlice(key, unique) {
+			unique = append(unique, key)
+		}
+	}
+	return unique, nil
+}
+
+func defaultSSHKeys() ([]string, error) {
+	usr, err := user.Current()
+	if err != nil {
+		return nil, err
+	}
+	keys := make([]string, 0)
+	for _, name := range DEFAULT_SSH_KEY_FILES {
+		found, err := readSSHKeyFile(filepath.Join(usr.HomeDir, ".ssh", name))
+		if os.IsNotExist(err) {
+			continue
+		}
+		if err != nil {
+			return nil, err
+		}
+		keys = append(keys, found...)
+	}
+	if len(keys) == 0 {
+		return nil, fmt.Errorf("no ssh public key found in %s/.ssh. Create one with ssh-keygen or pass --ssh-key", usr.HomeDir)
+	}
+	return keys, nil
+}
+
+func readSSHKeyFile(path string) ([]string, error) {
+	if strings.HasPrefix(path, "~/") {
+		usr, err := user.Current()
+		if err != nil {
+			return nil, err
+		}
+		path = filepath.Join(usr.HomeDir, path[2:])
+	}
+	content, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	return parseSSHKeys(string(content))
+}
+
+func agentSSHKeys() ([]string, error) {
+	out, err := exec.Command("ssh-add", "-L").Output()
+	if err != nil {
+		return nil, fmt.Errorf("could not list the keys of the ssh agent: %s", err)
+	}
+	return parseSSHKeys(string(out))
+}
+
+// githubSSHKeys returns the public keys of a GitHub user. They are cached
+// in the working directory, delete the cache file to fetch them again.
+func githubSSHKeys(workDir, name string) ([]string, error) {
+	if name == "" || strings.ContainsAny(name, "/.") {
+		return nil, fmt.Errorf("invalid GitHub user %q", name)
+	}
+	cacheFile := fmt.Sprintf("%s/keys/gh/%s.keys", workDir, name)
+	content, err := ioutil.ReadFile(cacheFile)
+	if os.IsNotExist(err) {
+		content, err = fetchGithubSSHKeys(name)
+		if err != nil {
+			return nil, err
+		}
+		err = os.MkdirAll(filepath.Dir(cacheFile), os.ModePerm)
+		if err == nil {
+			err = ioutil.WriteFile(cacheFile, content, 0644)
+		}
+	}
+	if err != nil {
+		return nil, err
+	}
+	return parseSSHKeys(string(content))
+}
+
+func fetchGithubSSHKeys(name string) ([]byte, error) {
+	resp, err := http.Get(fmt.Sprintf(GITHUB_KEYS_URL, name))
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("could not fetch keys of GitHub user %s: %s", name, resp.Status)
+	}
+	return ioutil.ReadAll(resp.Body)
+}
+
+// parseSSHKeys reads keys in authorized_keys format. Empty lines and
+// comments are skipped.
+func parseSSHKeys(content string) ([]string, error) {
+	keys := make([]string, 0)
+	for _, line := range strings.Split(content, "\n") {
+		line = strings.TrimSpace(line)
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		if !isSSHKey(line) {
+			return nil, fmt.Errorf("invalid public key %q", truncate(line, 40))
+		}
+		keys = append(keys, line)
+	}
+	return keys, nil
+}
+
+func isSSHKey(key string) bool {
+	fields := strings.Fields(key)
+	if len(fields) < 2 {
+		return false
+	}
+	for _, prefix := range []string{"ssh-", "ecdsa-sha2-", "sk-"} {
+		if strings.HasPrefix(fields[0], prefix) {
+			return true
+		}
+	}
+	return false
+}
+
+func truncate(text string, length int) string {
+	if len(text) <= length {
+		return text
+	}
+	return text[:length] + "..."
+}
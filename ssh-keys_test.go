@@ -0,0 +1,172 @@
+package main
+
+import (
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"sync"
+	"testing"
+)
+
+const (
+	testKey1 = "ssh-ed25519 AAAAC3NzaC1lZDI1NTE5AAAAIKEY1 alice@laptop"
+	testKey2 = "ecdsa-sha2-nistp256 AAAAE2VjZHNhLXNoYTItbmlzdHAyNTYKEY2 bob@desktop"
+	testKey3 = "ssh-rsa AAAAB3NzaC1yc2EAAAADAQABAAABAQKEY3"
+)
+
+func sshKeyDir(t *testing.T) (string, func()) {
+	dir, err := ioutil.TempDir("", "node-manager")
+	if err != nil {
+		t.Fatal(err)
+	}
+	return dir, func() { os.RemoveAll(dir) }
+}
+
+func writeKeyFile(t *testing.T, dir, name, content string) string {
+	path := filepath.Join(dir, name)
+	err := ioutil.WriteFile(path, []byte(content), 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+func TestCollectSSHKeysFromFilesAndLiterals(t *testing.T) {
+	dir, cleanup := sshKeyDir(t)
+	defer cleanup()
+	keyFile := writeKeyFile(t, dir, "keys.pub", "# team keys\n\n"+testKey1+"\n  "+testKey2+"  \n")
+	emptyFile := writeKeyFile(t, dir, "empty.pub", "# no keys yet\n")
+	invalidFile := writeKeyFile(t, dir, "invalid.pub", testKey1+"\nnot a key\n")
+
+	cases := []struct {
+		specs    []string
+		expected []string
+		message  string
+	}{
+		{[]string{testKey1}, []string{testKey1}, ""},
+		{[]string{" " + testKey3 + "\n"}, []string{testKey3}, ""},
+		{[]string{keyFile}, []string{testKey1, testKey2}, ""},
+		{[]string{testKey2, keyFile, testKey3}, []string{testKey2, testKey1, testKey3}, ""},
+		{[]string{emptyFile}, nil, "no keys found"},
+		{[]string{invalidFile}, nil, "invalid public key"},
+		{[]string{filepath.Join(dir, "missing.pub")}, nil, "no such file"},
+		{[]string{"ssh-ed25519"}, nil, "no such file"},
+	}
+	for _, c := range cases {
+		keys, err := collectSSHKeys(dir, c.specs)
+		if c.message != "" {
+			if err == nil || !strings.Contains(err.Error(), c.message) {
+				t.Errorf("%q: got %v, expected an error about %s", c.specs, err, c.message)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("%q: %s", c.specs, err)
+		} else if !reflect.DeepEqual(keys, c.expected) {
+			t.Errorf("%q: got %q, expected %q", c.specs, keys, c.expected)
+		}
+	}
+}
+
+// fakeSSHAdd puts an ssh-add on the PATH that prints output.
+func fakeSSHAdd(t *testing.T, dir, output string) func() {
+	bin := filepath.Join(dir, "bin")
+	err := os.Mkdir(bin, 0755)
+	if err == nil {
+		err = ioutil.WriteFile(filepath.Join(bin, "ssh-add"), []byte("#!/bin/sh\nprintf '"+output+"'\n"), 0755)
+	}
+	if err != nil {
+		t.Fatal(err)
+	}
+	path := os.Getenv("PATH")
+	os.Setenv("PATH", bin+string(os.PathListSeparator)+path)
+	return func() { os.Setenv("PATH", path) }
+}
+
+func TestCollectSSHKeysFromAgent(t *testing.T) {
+	dir, cleanup := sshKeyDir(t)
+	defer cleanup()
+	restore := fakeSSHAdd(t, dir, testKey1+"\\n"+testKey3+"\\n")
+	defer restore()
+
+	keys, err := collectSSHKeys(dir, []string{"agent:", testKey1})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if expected := []string{testKey1, testKey3}; !reflect.DeepEqual(keys, expected) {
+		t.Errorf("got %q, expected %q", keys, expected)
+	}
+}
+
+func TestCollectSSHKeysFromEmptyAgent(t *testing.T) {
+	dir, cleanup := sshKeyDir(t)
+	defer cleanup()
+	restore := fakeSSHAdd(t, dir, "")
+	defer restore()
+
+	_, err := collectSSHKeys(dir, []string{"agent:"})
+	if err == nil || !strings.Contains(err.Error(), "no keys found") {
+		t.Errorf("got %v", err)
+	}
+}
+
+func TestCollectSSHKeysFromGithub(t *testing.T) {
+	var lock sync.Mutex
+	requests := make([]string, 0)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		lock.Lock()
+		requests = append(requests, r.URL.Path)
+		lock.Unlock()
+		switch r.URL.Path {
+		case "/alice.keys":
+			w.Write([]byte(testKey1 + "\n" + testKey2 + "\n"))
+		case "/nokeys.keys":
+		default:
+			http.NotFound(w, r)
+		}
+	}))
+	defer server.Close()
+	defer func(url string) { GITHUB_KEYS_URL = url }(GITHUB_KEYS_URL)
+	GITHUB_KEYS_URL = server.URL + "/%s.keys"
+	dir, cleanup := sshKeyDir(t)
+	defer cleanup()
+
+	for i := 0; i < 2; i++ {
+		keys, err := collectSSHKeys(dir, []string{"gh:alice"})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if expected := []string{testKey1, testKey2}; !reflect.DeepEqual(keys, expected) {
+			t.Errorf("got %q, expected %q", keys, expected)
+		}
+	}
+	if len(requests) != 1 {
+		t.Errorf("the keys were fetched %d times instead of once from the cache", len(requests))
+	}
+	if _, err := os.Stat(filepath.Join(dir, "keys", "gh", "alice.keys")); err != nil {
+		t.Errorf("the keys were not cached: %s", err)
+	}
+
+	cases := []struct {
+		spec    string
+		message string
+	}{
+		{"gh:nokeys", "no keys found"},
+		{"gh:missing", "404"},
+		{"gh:", "invalid GitHub user"},
+		{"gh:../alice", "invalid GitHub user"},
+	}
+	for _, c := range cases {
+		_, err := collectSSHKeys(dir, []string{c.spec})
+		if err == nil || !strings.Contains(err.Error(), c.message) {
+			t.Errorf("%s: got %v, expected an error about %s", c.spec, err, c.message)
+		}
+	}
+	if _, err := os.Stat(filepath.Join(dir, "keys", "gh", "missing.keys")); !os.IsNotExist(err) {
+		t.Errorf("a failed fetch was cached")
+	}
+}
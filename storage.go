@@ -0,0 +1,321 @@
+package main
+
+import (
+	"bytes"
+	"encoding/xml"
+	"fmt"
+	"io"
+	"net/url"
+	"os"
+	"path/filepath"
+
+	libvirt "github.com/libvirt/libvirt-go"
+	"github.com/urfave/cli"
+)
+
+// nodeStorage places the disk and the seed image or Ignition config of a
+// node where the hypervisor can reach them and returns their paths on the
+// hypervisor.
+type nodeStorage interface {
+	createDisk(node string, entry *IndexEntry, size uint64) (string, error)
+	createSeed(node string, iso []byte) (string, error)
+	createIgnition(node string, config []byte) (string, error)
+	close() error
+}
+
+func newNodeStorage(c *cli.Context, conn *libvirt.Connect, workDir string) (nodeStorage, error) {
+	remote, err := isRemoteConnection(conn)
+	if err != nil {
+		return nil, err
+	}
+	path := c.GlobalString("pool-path")
+	if path == "" && remote {
+		path = "/var/lib/libvirt/images/node-manager"
+	} else if path == "" {
+		path = fmt.Sprintf("%s/pool", workDir)
+	}
+	pool, err := ensurePool(conn, c.GlobalString("pool"), path)
+	if err != nil {
+		return nil, err
+	}
+	return &poolStorage{conn, pool, workDir, remote}, nil
+}
+
+// ensurePool adopts the directory storage pool called name or defines it
+// with its volumes in path. The pool is started if necessary.
+func ensurePool(conn *libvirt.Connect, name, path string) (*libvirt.StoragePool, error) {
+	pool, err := conn.LookupStoragePoolByName(name)
+	if lverr, ok := err.(libvirt.Error); ok && lverr.Code == libvirt.ERR_NO_STORAGE_POOL {
+		fmt.Printf("creating storage pool %s in %s\n", name, path)
+		def := &poolDef{Type: "dir", Name: name, Target: poolTarget{Path: path}}
+		poolXML, err := xml.Marshal(def)
+		if err != nil {
+			return nil, err
+		}
+		pool, err = conn.StoragePoolDefineXML(string(poolXML), 0)
+		if err != nil {
+			return nil, err
+		}
+		err = pool.Build(libvirt.STORAGE_POOL_BUILD_NEW)
+		if err == nil {
+			err = pool.SetAutostart(true)
+		}
+		if err != nil {
+			pool.Undefine()
+			pool.Free()
+			return nil, err
+		}
+	} else if err != nil {
+		return nil, err
+	}
+
+	active, err := pool.IsActive()
+	if err == nil && !active {
+		err = pool.Create(0)
+	}
+	if err != nil {
+		pool.Free()
+		return nil, fmt.Errorf("could not start storage pool %s: %s", name, err)
+	}
+	return pool, nil
+}
+
+func isRemoteConnection(conn *libvirt.Connect) (bool, error) {
+	uri, err := conn.GetURI()
+	if err != nil {
+		return false, err
+	}
+	parsed, err := url.Parse(uri)
+	if err != nil {
+		return false, err
+	}
+	return parsed.Host != "", nil
+}
+
+// poolStorage keeps disks and seed images as volumes of a storage pool,
+// which also works for remote hypervisors. Base images are added once and
+// shared by all nodes of the pool.
+type poolStorage struct {
+	conn    *libvirt.Connect
+	pool    *libvirt.StoragePool
+	workDir string
+	remote  bool
+}
+
+func (s *poolStorage) createDisk(node string, entry *IndexEntry, size uint64) (string, error) {
+	basePath, err := s.baseVolume(entry)
+	if err != nil {
+		return "", err
+	}
+	localBase := entry.path(s.workDir)
+	format, baseSize, err := probeImage(localBase)
+	if err != nil {
+		return "", err
+	}
+	if size < baseSize {
+		// flavors size disks without knowing the image, so a smaller
+		// size is raised rather than rejected
+		if size > 0 {
+			fmt.Printf("increasing the disk of %s from %s to %s, the size of %s\n", node, formatBytes(size), formatBytes(baseSize), entry)
+		}
+		size = baseSize
+	}
+	overlay, err := qcow2Overlay(basePath, format, size)
+	if err != nil {
+		return "", err
+	}
+	return s.upload(node+".qcow2", bytes.NewReader(overlay), uint64(len(overlay)))
+}
+
+func (s *poolStorage) createSeed(node string, iso []byte) (string, error) {
+	return s.upload(node+"-seed.iso", bytes.NewReader(iso), uint64(len(iso)))
+}
+
+func (s *poolStorage) createIgnition(node string, config []byte) (string, error) {
+	return s.upload(node+".ign", bytes.NewReader(config), uint64(len(config)))
+}
+
+func (s *poolStorage) baseVolume(entry *IndexEntry) (string, error) {
+	localBase := entry.path(s.workDir)
+	name := baseVolumeName(s.workDir, entry)
+	vol, err := s.pool.LookupStorageVolByName(name)
+	if err == nil {
+		defer vol.Free()
+		return vol.GetPath()
+	}
+
+	if !s.remote {
+		path, err := s.linkIntoPool(localBase, name)
+		if err == nil {
+			return path, nil
+		}
+	}
+
+	f, err := os.Open(localBase)
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+	info, err := f.Stat()
+	if err != nil {
+		return "", err
+	}
+	fmt.Printf("uploading %s\n", name)
+	return s.upload(name, f, uint64(info.Size()))
+}
+
+// baseVolumeName is the name of the volume that holds the base image of
+// entry in the pool.
+func baseVolumeName(workDir string, entry *IndexEntry) string {
+	return fmt.Sprintf("%s-%s", entry.source, filepath.Base(entry.path(workDir)))
+}
+
+// linkIntoPool hard links a local file into the pool directory, which saves
+// copying gigabytes when the pool lives on the same file system.
+func (s *poolStorage) linkIntoPool(file, name string) (string, error) {
+	raw, err := s.pool.GetXMLDesc(0)
+	if err != nil {
+		return "", err
+	}
+	def := &poolDef{}
+	err = xml.Unmarshal([]byte(raw), def)
+	if err != nil {
+		return "", err
+	}
+	if def.Type != "dir" {
+		return "", fmt.Errorf("pool is no directory pool")
+	}
+	err = os.Link(file, filepath.Join(def.Target.Path, name))
+	if err != nil {
+		return "", err
+	}
+	err = s.pool.Refresh(0)
+	if err != nil {
+		return "", err
+	}
+	vol, err := s.pool.LookupStorageVolByName(name)
+	if err != nil {
+		return "", err
+	}
+	defer vol.Free()
+	return vol.GetPath()
+}
+
+// upload creates a volume and streams content into it. The volume is
+// created as raw, libvirt detects the actual format on refresh.
+func (s *poolStorage) upload(name string, content io.Reader, length uint64) (string, error) {
+	def := &volumeDef{
+		Name:     name,
+		Capacity: volumeCapacity{Unit: "bytes", Value: length},
+		Target:   volumeTarget{Format: volumeFormat{Type: "raw"}},
+	}
+	volXML, err := xml.Marshal(def)
+	if err != nil {
+		return "", err
+	}
+	vol, err := s.pool.StorageVolCreateXML(string(volXML), 0)
+	if err != nil {
+		return "", err
+	}
+	defer vol.Free()
+
+	err = uploadToVolume(s.conn, vol, content, length)
+	if err != nil {
+		deleteErr := vol.Delete(0)
+		if deleteErr != nil {
+			fmt.Printf("could not delete volume %s: %s\n", name, deleteErr)
+		}
+		return "", err
+	}
+	err = s.pool.Refresh(0)
+	if err != nil {
+		return "", err
+	}
+	return vol.GetPath()
+}
+
+func (s *poolStorage) close() error {
+	return s.pool.Free()
+}
+
+func uploadToVolume(conn *libvirt.Connect, vol *libvirt.StorageVol, content io.Reader, length uint64) error {
+	stream, err := conn.NewStream(0)
+	if err != nil {
+		return err
+	}
+	defer stream.Free()
+
+	err = vol.Upload(stream, 0, length, 0)
+	if err != nil {
+		return err
+	}
+
+	buf := make([]byte, 1024*1024)
+	for {
+		n, readErr := content.Read(buf)
+		for sent := 0; sent < n; {
+			m, err := stream.Send(buf[sent:n])
+			if err != nil {
+				stream.Abort()
+				return err
+			}
+			sent += m
+		}
+		if readErr == io.EOF {
+			break
+		}
+		if readErr != nil {
+			stream.Abort()
+			return readErr
+		}
+	}
+	return stream.Finish()
+}
+
+// deleteVolumes removes the storage volumes behind paths. Paths that do not
+// belong to any storage pool are skipped.
+func deleteVolumes(conn *libvirt.Connect, paths []string) error {
+	for _, path := range paths {
+		vol, err := conn.LookupStorageVolByPath(path)
+		if err != nil {
+			continue
+		}
+		err = vol.Delete(0)
+		vol.Free()
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+type poolDef struct {
+	XMLName xml.Name   `xml:"pool"`
+	Type    string     `xml:"type,attr"`
+	Name    string     `xml:"name"`
+	Target  poolTarget `xml:"target"`
+}
+
+type poolTarget struct {
+	Path string `xml:"path"`
+}
+
+type volumeDef struct {
+	XMLName  xml.Name       `xml:"volume"`
+	Name     string         `xml:"name"`
+	Capacity volumeCapacity `xml:"capacity"`
+	Target   volumeTarget   `xml:"target"`
+}
+
+type volumeCapacity struct {
+	Unit  string `xml:"unit,attr"`
+	Value uint64 `xml:",chardata"`
+}
+
+type volumeTarget struct {
+	Format volumeFormat `xml:"format"`
+}
+
+type volumeFormat struct {
+	Type string `xml:"type,attr"`
+}
@@ -0,0 +1,222 @@
+package main
+
+import (
+	"bytes"
+	"encoding/base64"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"mime"
+	"mime/multipart"
+	"net/mail"
+	"net/textproto"
+	"path/filepath"
+	"strings"
+	"text/template"
+
+	yaml "gopkg.in/yaml.v2"
+)
+
+// userDataContext is the data user-data templates are executed with.
+type userDataContext struct {
+	Number   int
+	Name     string
+	Hostname string
+	Cluster  string
+	Group    string
+	SSHKeys  []string
+}
+
+type userDataPart struct {
+	contentType string
+	content     string
+	source      string
+}
+
+// renderUserData executes the user-data templates in files and merges them
+// into the built-in cloud-config defaults. All cloud-configs end up in one
+// document. Shell scripts and other parts turn the result into a multipart
+// MIME message.
+func renderUserData(files []string, defaults map[interface{}]interface{}, ctx userDataContext) (string, error) {
+	merged := defaults
+	extraParts := make([]userDataPart, 0)
+	for _, file := range files {
+		rendered, err := renderTemplate(file, ctx)
+		if err != nil {
+			return "", err
+		}
+		parts, err := splitUserData(rendered, file)
+		if err != nil {
+			return "", err
+		}
+		for _, part := range parts {
+			if part.contentType != "text/cloud-config" {
+				extraParts = append(extraParts, part)
+				continue
+			}
+			cloudConfig := make(map[interface{}]interface{})
+			err = yaml.Unmarshal([]byte(part.content), &cloudConfig)
+			if err != nil {
+				return "", fmt.Errorf("%s: invalid cloud-config: %s", part.source, err)
+			}
+			merged = mergeCloudConfig(merged, cloudConfig)
+		}
+	}
+
+	raw, err := yaml.Marshal(merged)
+	if err != nil {
+		return "", err
+	}
+	cloudConfig := "#cloud-config\n" + string(raw)
+	if len(extraParts) == 0 {
+		return cloudConfig, nil
+	}
+	parts := append([]userDataPart{{contentType: "text/cloud-config", content: cloudConfig, source: "cloud-config"}}, extraParts...)
+	return multipartUserData(parts)
+}
+
+func renderTemplate(file string, ctx userDataContext) (string, error) {
+	content, err := ioutil.ReadFile(file)
+	if err != nil {
+		return "", err
+	}
+	tmpl, err := template.New(filepath.Base(file)).Option("missingkey=error").Parse(string(content))
+	if err != nil {
+		return "", err
+	}
+	buf := &bytes.Buffer{}
+	err = tmpl.Execute(buf, ctx)
+	if err != nil {
+		return "", err
+	}
+	return buf.String(), nil
+}
+
+// splitUserData classifies rendered user-data by its first line the way
+// cloud-init does. Multipart MIME messages are split into their parts.
+func splitUserData(content, source string) ([]userDataPart, error) {
+	if strings.HasPrefix(content, "Content-Type:") || strings.HasPrefix(content, "MIME-Version:") {
+		return splitMultipart(content, source)
+	}
+	contentType, err := detectUserDataType(content)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %s", source, err)
+	}
+	return []userDataPart{{contentType: contentType, content: content, source: source}}, nil
+}
+
+func detectUserDataType(content string) (string, error) {
+	prefixes := []struct {
+		prefix      string
+		contentType string
+	}{
+		{"#cloud-config", "text/cloud-config"},
+		{"#!", "text/x-shellscript"},
+		{"#cloud-boothook", "text/cloud-boothook"},
+		{"#include", "text/x-include-url"},
+	}
+	for _, p := range prefixes {
+		if strings.HasPrefix(content, p.prefix) {
+			return p.contentType, nil
+		}
+	}
+	return "", fmt.Errorf("unknown user-data format. Expected #cloud-config, a script starting with #! or multipart MIME")
+}
+
+func splitMultipart(content, source string) ([]userDataPart, error) {
+	msg, err := mail.ReadMessage(strings.NewReader(content))
+	if err != nil {
+		return nil, fmt.Errorf("%s: invalid MIME message: %s", source, err)
+	}
+	mediaType, params, err := mime.ParseMediaType(msg.Header.Get("Content-Type"))
+	if err != nil {
+		return nil, fmt.Errorf("%s: %s", source, err)
+	}
+	if !strings.HasPrefix(mediaType, "multipart/") {
+		return nil, fmt.Errorf("%s: expected a multipart message, got %s", source, mediaType)
+	}
+
+	parts := make([]userDataPart, 0)
+	reader := multipart.NewReader(msg.Body, params["boundary"])
+	for {
+		part, err := reader.NextPart()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, fmt.Errorf("%s: %s", source, err)
+		}
+		body, err := ioutil.ReadAll(part)
+		if err != nil {
+			return nil, fmt.Errorf("%s: %s", source, err)
+		}
+		if strings.EqualFold(part.Header.Get("Content-Transfer-Encoding"), "base64") {
+			body, err = base64.StdEncoding.DecodeString(strings.Join(strings.Fields(string(body)), ""))
+			if err != nil {
+				return nil, fmt.Errorf("%s: %s", source, err)
+			}
+		}
+
+		partSource := source
+		if name := part.FileName(); name != "" {
+			partSource = fmt.Sprintf("%s (%s)", source, name)
+		}
+		contentType, _, err := mime.ParseMediaType(part.Header.Get("Content-Type"))
+		if err != nil {
+			contentType, err = detectUserDataType(string(body))
+			if err != nil {
+				return nil, fmt.Errorf("%s: %s", partSource, err)
+			}
+		}
+		parts = append(parts, userDataPart{contentType: contentType, content: string(body), source: partSource})
+	}
+	return parts, nil
+}
+
+// mergeCloudConfig merges override into base. Nested mappings are merged,
+// lists are appended and all other values are replaced.
+func mergeCloudConfig(base, override map[interface{}]interface{}) map[interface{}]interface{} {
+	merged := make(map[interface{}]interface{}, len(base))
+	for key, value := range base {
+		merged[key] = value
+	}
+	for key, value := range override {
+		switch value := value.(type) {
+		case map[interface{}]interface{}:
+			if existing, ok := merged[key].(map[interface{}]interface{}); ok {
+				merged[key] = mergeCloudConfig(existing, value)
+				continue
+			}
+		case []interface{}:
+			if existing, ok := merged[key].([]interface{}); ok {
+				merged[key] = append(append([]interface{}{}, existing...), value...)
+				continue
+			}
+		}
+		merged[key] = value
+	}
+	return merged
+}
+
+func multipartUserData(parts []userDataPart) (string, error) {
+	body := &bytes.Buffer{}
+	writer := multipart.NewWriter(body)
+	for i, part := range parts {
+		header := textproto.MIMEHeader{}
+		header.Set("Content-Type", part.contentType)
+		header.Set("Content-Disposition", fmt.Sprintf(`attachment; filename="part-%02d"`, i))
+		w, err := writer.CreatePart(header)
+		if err != nil {
+			return "", err
+		}
+		_, err = w.Write([]byte(part.content))
+		if err != nil {
+			return "", err
+		}
+	}
+	err := writer.Close()
+	if err != nil {
+		return "", err
+	}
+	return fmt.Sprintf("Content-Type: multipart/mixed; boundary=\"%s\"\nMIME-Version: 1.0\n\n%s", writer.Boundary(), body), nil
+}
@@ -0,0 +1,231 @@
+package main
+
+import (
+	"encoding/base64"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+
+	yaml "gopkg.in/yaml.v2"
+)
+
+var testUserDataContext = userDataContext{
+	Number:   1,
+	Name:     "atomic-host1",
+	Hostname: "atomic1",
+	Cluster:  "test",
+	Group:    "workers",
+	SSHKeys:  []string{"ssh-ed25519 AAAA test"},
+}
+
+// writeUserData writes each template to its own file and returns the paths.
+func writeUserData(t *testing.T, templates ...string) ([]string, func()) {
+	dir, err := ioutil.TempDir("", "node-manager")
+	if err != nil {
+		t.Fatal(err)
+	}
+	files := make([]string, len(templates))
+	for i, content := range templates {
+		files[i] = filepath.Join(dir, fmt.Sprintf("user-data-%d", i))
+		err = ioutil.WriteFile(files[i], []byte(content), 0644)
+		if err != nil {
+			os.RemoveAll(dir)
+			t.Fatal(err)
+		}
+	}
+	return files, func() { os.RemoveAll(dir) }
+}
+
+func TestRenderTemplate(t *testing.T) {
+	cases := []struct {
+		template string
+		expected string
+		fails    bool
+	}{
+		{"#cloud-config\nhostname: {{.Hostname}}\n", "#cloud-config\nhostname: atomic1\n", false},
+		{"{{.Name}} of {{.Cluster}}/{{.Group}} is number {{.Number}}", "atomic-host1 of test/workers is number 1", false},
+		{"{{range .SSHKeys}}- {{.}}\n{{end}}", "- ssh-ed25519 AAAA test\n", false},
+		{"hostname: {{.Missing}}", "", true},
+		{"hostname: {{.Hostname", "", true},
+	}
+	for _, c := range cases {
+		files, cleanup := writeUserData(t, c.template)
+		out, err := renderTemplate(files[0], testUserDataContext)
+		cleanup()
+		if (err != nil) != c.fails || out != c.expected {
+			t.Errorf("%q: got %q, %v", c.template, out, err)
+		}
+	}
+}
+
+func TestMergeCloudConfig(t *testing.T) {
+	cases := []struct {
+		name     string
+		base     string
+		override string
+		expected string
+	}{
+		{"scalars are replaced", "hostname: a\npassword: x", "hostname: b", "hostname: b\npassword: x"},
+		{"mappings are merged", "chpasswd: {expire: false, list: [a]}", "chpasswd: {expire: true}", "chpasswd: {expire: true, list: [a]}"},
+		{"lists are appended", "runcmd: [a, b]", "runcmd: [c]", "runcmd: [a, b, c]"},
+		{"nested lists are appended", "users: [default]\nwrite_files: [{path: /a}]", "write_files: [{path: /b}]", "users: [default]\nwrite_files: [{path: /a}, {path: /b}]"},
+		{"other types are replaced", "packages: [a]", "packages: b", "packages: b"},
+		{"new keys are added", "hostname: a", "runcmd: [b]", "hostname: a\nruncmd: [b]"},
+	}
+	parse := func(content string) map[interface{}]interface{} {
+		value := make(map[interface{}]interface{})
+		err := yaml.Unmarshal([]byte(content), &value)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return value
+	}
+	for _, c := range cases {
+		base := parse(c.base)
+		merged := mergeCloudConfig(base, parse(c.override))
+		if !reflect.DeepEqual(merged, parse(c.expected)) {
+			t.Errorf("%s: got %v", c.name, merged)
+		}
+		if !reflect.DeepEqual(base, parse(c.base)) {
+			t.Errorf("%s: the base was modified to %v", c.name, base)
+		}
+	}
+}
+
+// parseUserData splits rendered user-data into its parts and checks that
+// every cloud-config is valid YAML.
+func parseUserData(t *testing.T, userData string) ([]userDataPart, []map[interface{}]interface{}) {
+	parts, err := splitUserData(userData, "user-data")
+	if err != nil {
+		t.Fatal(err)
+	}
+	configs := make([]map[interface{}]interface{}, 0)
+	for _, part := range parts {
+		if part.contentType != "text/cloud-config" {
+			continue
+		}
+		if !strings.HasPrefix(part.content, "#cloud-config\n") {
+			t.Errorf("cloud-config %q lacks its header", part.content)
+		}
+		config := make(map[interface{}]interface{})
+		err = yaml.Unmarshal([]byte(part.content), &config)
+		if err != nil {
+			t.Errorf("invalid cloud-config: %s\n%s", err, part.content)
+		}
+		configs = append(configs, config)
+	}
+	return parts, configs
+}
+
+func TestRenderUserData(t *testing.T) {
+	defaults := map[interface{}]interface{}{
+		"hostname": "atomic1",
+		"runcmd":   []interface{}{"default"},
+	}
+	cases := []struct {
+		name      string
+		templates []string
+		types     []string
+		config    string
+	}{
+		{
+			name:   "defaults only",
+			types:  []string{"text/cloud-config"},
+			config: "hostname: atomic1\nruncmd: [default]",
+		},
+		{
+			name: "cloud-configs are merged",
+			templates: []string{
+				"#cloud-config\nruncmd: [first]\nwrite_files: [{path: /etc/{{.Cluster}}}]\n",
+				"#cloud-config\nhostname: {{.Name}}\nruncmd: [second]\n",
+			},
+			types:  []string{"text/cloud-config"},
+			config: "hostname: atomic-host1\nruncmd: [default, first, second]\nwrite_files: [{path: /etc/test}]",
+		},
+		{
+			name: "scripts make a multipart message",
+			templates: []string{
+				"#!/bin/sh\necho {{.Hostname}}\n",
+				"#cloud-config\nruncmd: [first]\n",
+				"#cloud-boothook\necho boot\n",
+			},
+			types:  []string{"text/cloud-config", "text/x-shellscript", "text/cloud-boothook"},
+			config: "hostname: atomic1\nruncmd: [default, first]",
+		},
+		{
+			name: "multipart templates are split",
+			templates: []string{
+				"Content-Type: multipart/mixed; boundary=\"b\"\nMIME-Version: 1.0\n\n" +
+					"--b\nContent-Type: text/cloud-config\n\n#cloud-config\nruncmd: [first]\n" +
+					"--b\nContent-Type: text/x-shellscript\nContent-Transfer-Encoding: base64\n\n" +
+					base64.StdEncoding.EncodeToString([]byte("#!/bin/sh\necho hi\n")) + "\n--b--\n",
+			},
+			types:  []string{"text/cloud-config", "text/x-shellscript"},
+			config: "hostname: atomic1\nruncmd: [default, first]",
+		},
+	}
+	for _, c := range cases {
+		files, cleanup := writeUserData(t, c.templates...)
+		userData, err := renderUserData(files, defaults, testUserDataContext)
+		cleanup()
+		if err != nil {
+			t.Errorf("%s: %s", c.name, err)
+			continue
+		}
+		parts, configs := parseUserData(t, userData)
+		types := make([]string, len(parts))
+		for i, part := range parts {
+			types[i] = part.contentType
+		}
+		if !reflect.DeepEqual(types, c.types) {
+			t.Errorf("%s: got parts %q, expected %q", c.name, types, c.types)
+		}
+		expected := make(map[interface{}]interface{})
+		err = yaml.Unmarshal([]byte(c.config), &expected)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(configs) != 1 || !reflect.DeepEqual(configs[0], expected) {
+			t.Errorf("%s: got cloud-configs %v, expected %v", c.name, configs, expected)
+		}
+	}
+}
+
+func TestRenderUserDataScriptPart(t *testing.T) {
+	files, cleanup := writeUserData(t, "#!/bin/sh\necho {{.Hostname}}\n")
+	defer cleanup()
+	userData, err := renderUserData(files, map[interface{}]interface{}{}, testUserDataContext)
+	if err != nil {
+		t.Fatal(err)
+	}
+	parts, _ := parseUserData(t, userData)
+	if len(parts) != 2 || parts[1].content != "#!/bin/sh\necho atomic1\n" || parts[1].source != "user-data (part-01)" {
+		t.Errorf("got parts %+v", parts)
+	}
+}
+
+func TestRenderUserDataRejectsInvalidParts(t *testing.T) {
+	cases := []struct {
+		name     string
+		template string
+		message  string
+	}{
+		{"invalid yaml", "#cloud-config\nruncmd: [unclosed\n", "invalid cloud-config"},
+		{"unknown format", "hostname: atomic1\n", "unknown user-data format"},
+		{"missing field", "#cloud-config\nhostname: {{.Domain}}\n", "Domain"},
+		{"invalid part", "Content-Type: multipart/mixed; boundary=\"b\"\n\n--b\n\nhostname: x\n--b--\n", "unknown user-data format"},
+		{"no multipart", "Content-Type: text/plain\n\nhello\n", "expected a multipart message"},
+	}
+	for _, c := range cases {
+		files, cleanup := writeUserData(t, c.template)
+		_, err := renderUserData(files, map[interface{}]interface{}{}, testUserDataContext)
+		cleanup()
+		if err == nil || !strings.Contains(err.Error(), c.message) {
+			t.Errorf("%s: got %v, expected an error about %s", c.name, err, c.message)
+		}
+	}
+}
@@ -1,24 +1,24 @@
 package main
 
 import (
-	"bufio"
-	"crypto/sha256"
+	"bytes"
+	"compress/bzip2"
+	"compress/gzip"
 	"fmt"
 	"io"
+	"io/ioutil"
 	"log"
-	"net/http"
 	"os"
 	"os/exec"
 	"os/user"
-	"strconv"
+	"path/filepath"
 	"strings"
+	"sync"
 
 	libvirt "github.com/libvirt/libvirt-go"
 	"github.com/urfave/cli"
 )
 
-const BASE_URL = "http://cloud.centos.org/centos/7/atomic/images/"
-
 func run(cmdStr string, args ...string) error {
 	cmd := exec.Command(cmdStr, args...)
 	stdoutAndErr, err := cmd.CombinedOutput()
@@ -79,8 +79,12 @@ func cp(src, dst string) error {
 	return writeToFile(in, dst)
 }
 
+func connect(c *cli.Context) (*libvirt.Connect, error) {
+	return libvirt.NewConnect(c.GlobalString("connect"))
+}
+
 func getProjectDir(c *cli.Context) string {
-	dir := c.String("dir")
+	dir := c.GlobalString("dir")
 	if dir == "" {
 		usr, err := user.Current()
 		if err != nil {
@@ -101,142 +105,305 @@ func getProjectDir(c *cli.Context) string {
 type nodeCallback func(*libvirt.Domain, string, string) error
 
 type IndexEntry struct {
-	version   int
-	shaSum    string
-	fileName  string
-	isPresent bool
+	source      string
+	version     string
+	arch        string
+	compression string
+	shaSum      string
+	fileName    string
+	url         string
+	isPresent   bool
 }
 
-func (i *IndexEntry) Download(workDir string) error {
-	path := fmt.Sprintf("%s/base/images/%s", workDir, i.fileName)
-	downloadURL := fmt.Sprintf("%s/%s", BASE_URL, i.fileName)
+func (i *IndexEntry) String() string {
+	return fmt.Sprintf("%s:%s (%s)", i.source, i.version, i.arch)
+}
 
-	resp, err := http.Get(downloadURL)
+func (i *IndexEntry) ref() string {
+	return fmt.Sprintf("%s:%s", i.source, i.version)
+}
 
-	if err != nil {
-		return err
+// path is the location of the decompressed image, which serves as backing
+// file for the disks of the nodes.
+func (i *IndexEntry) path(workDir string) string {
+	name := i.fileName
+	if i.compression != "" {
+		name = strings.TrimSuffix(name, "."+i.compression)
 	}
+	return fmt.Sprintf("%s/images/%s", sourceDir(workDir, i.source), name)
+}
 
-	defer resp.Body.Close()
+func (i *IndexEntry) downloadPath(workDir string) string {
+	return fmt.Sprintf("%s/images/%s", sourceDir(workDir, i.source), i.fileName)
+}
 
-	baseImageFile, err := os.Create(path)
+func sourceDir(workDir, source string) string {
+	return fmt.Sprintf("%s/base/%s", workDir, source)
+}
 
+// Download fetches the image, verifies it against the checksum of the index
+// and unpacks it. A compressed download that was verified before is reused.
+func (i *IndexEntry) Download(workDir string, progress *ProgressWriter) error {
+	path := i.downloadPath(workDir)
+	if i.compression != "" {
+		actualSha, err := fileSha256(path)
+		if err == nil && actualSha == i.shaSum {
+			return i.unpack(workDir)
+		}
+	}
+	err := downloadFile(i.url, path, i.shaSum, progress)
 	if err != nil {
 		return err
 	}
+	return i.unpack(workDir)
+}
 
-	shaSink := sha256.New()
-	contentLength, err := strconv.Atoi(resp.Header.Get("Content-Length"))
+// unpack decompresses a downloaded image once, so that nodes can use it as
+// backing file. The compressed download is removed afterwards.
+func (i *IndexEntry) unpack(workDir string) error {
+	if i.compression == "" {
+		return nil
+	}
+	compressedPath := i.downloadPath(workDir)
+	image, err := openImage(compressedPath, i.compression)
 	if err != nil {
 		return err
 	}
-	progressWriter := newProgressWriter(contentLength)
-	progressAndShaWriter := io.MultiWriter(shaSink, progressWriter)
-	teeReader := io.TeeReader(resp.Body, progressAndShaWriter)
-	_, err = io.Copy(baseImageFile, teeReader)
-	actualSha := fmt.Sprintf("%x", shaSink.Sum(nil))
-	if actualSha != i.shaSum {
-		err := os.Remove(path)
-		if err != nil {
-			log.Printf("could not delete file %s. Manual cleanup necessary.\n", path)
-		}
-		return fmt.Errorf("Downloaded has a different sha value then the index suggests.\n This means, someone has tempered with the image.\n actual sha: %s\n expected sha: %s", actualSha, i.shaSum)
-	}
+	defer image.Close()
 
-	return nil
+	fmt.Printf("Decompressing %s\n", i.fileName)
+	tmpPath := i.path(workDir) + ".tmp"
+	err = writeToFile(image, tmpPath)
+	if err != nil {
+		os.Remove(tmpPath)
+		return err
+	}
+	err = os.Rename(tmpPath, i.path(workDir))
+	if err != nil {
+		return err
+	}
+	return os.Remove(compressedPath)
 }
 
-func readIndex(workDir string) ([]*IndexEntry, error) {
-	location := fmt.Sprintf("%s/base/index.txt", workDir)
-	file, err := os.Open(location)
+// nodesUsingImage lists the nodes whose disks are backed by the image.
+func nodesUsingImage(workDir string, entry *IndexEntry) ([]string, error) {
+	nodeDirs, err := filepath.Glob(fmt.Sprintf("%s/images/*/base-image", workDir))
 	if err != nil {
 		return nil, err
 	}
-	result := make([]*IndexEntry, 0)
-	scanner := bufio.NewScanner(file)
-	for scanner.Scan() {
-		line := scanner.Text()
-		entry, err := parseIndexEntry(line, workDir)
+	result := make([]string, 0)
+	for _, location := range nodeDirs {
+		content, err := ioutil.ReadFile(location)
 		if err != nil {
 			return nil, err
 		}
-		result = append(result, entry)
+		if strings.TrimSpace(string(content)) == entry.ref() {
+			result = append(result, filepath.Base(filepath.Dir(location)))
+		}
 	}
-	if err = scanner.Err(); err != nil {
+	return result, nil
+}
+
+func readIndex(workDir string, src imageSource) ([]*IndexEntry, error) {
+	location := fmt.Sprintf("%s/index", sourceDir(workDir, src.name()))
+	file, err := os.Open(location)
+	if os.IsNotExist(err) {
+		return nil, fmt.Errorf("no index for image source %s. Run node-manager init --image %s first", src.name(), src.name())
+	}
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+	result, err := src.parseIndex(file)
+	if err != nil {
 		return nil, err
 	}
+	for _, entry := range result {
+		_, err = os.Stat(entry.path(workDir))
+		entry.isPresent = !os.IsNotExist(err)
+	}
+	sortIndexEntries(result)
 	return result, nil
 }
 
-func parseIndexEntry(rawLine, workDir string) (*IndexEntry, error) {
-	parts := strings.Split(rawLine, " ")
-	file := parts[len(parts)-1]
-	checksum := parts[0]
-	if !strings.HasPrefix(file, "CentOS-Atomic-Host-7.") || !strings.HasSuffix(file, "-GenericCloud.qcow2.gz") {
-		return nil, fmt.Errorf("invalid index entry")
+func selectIndexEntry(entries []*IndexEntry, version string) (*IndexEntry, error) {
+	candidates := make([]*IndexEntry, 0)
+	for _, entry := range entries {
+		if entry.arch == "" || stringInSlice(entry.arch, hostArchitectures()) {
+			candidates = append(candidates, entry)
+		}
+	}
+	if len(candidates) == 0 {
+		return nil, fmt.Errorf("index contains no images for this architecture")
+	}
+	if version == "" {
+		return candidates[len(candidates)-1], nil
 	}
+	for _, entry := range candidates {
+		if entry.version == version {
+			return entry, nil
+		}
+	}
+	versions := make([]string, 0, len(candidates))
+	for _, entry := range candidates {
+		versions = append(versions, entry.version)
+	}
+	return nil, fmt.Errorf("version %s not found in index. Available versions are %s", version, strings.Join(versions, ", "))
+}
+
+func stringInSlice(needle string, haystack []string) bool {
+	for _, s := range haystack {
+		if s == needle {
+			return true
+		}
+	}
+	return false
+}
 
-	parts = strings.Split(file, ".")
-	versionWithSuffix := parts[1]
-	version := strings.Split(versionWithSuffix, "-")[0]
+type imageReader struct {
+	io.Reader
+	closers []io.Closer
+}
 
-	if len(version) != 4 {
-		return nil, fmt.Errorf("invalid index entry")
+func (r *imageReader) Close() error {
+	var err error
+	for i := len(r.closers) - 1; i >= 0; i-- {
+		if closeErr := r.closers[i].Close(); err == nil {
+			err = closeErr
+		}
 	}
+	return err
+}
 
-	versionInt, err := strconv.Atoi(version)
+// openImage opens a base image and transparently decompresses it. xz has no
+// implementation in the standard library, so the xz binary is used for it.
+func openImage(path, compression string) (io.ReadCloser, error) {
+	f, err := os.Open(path)
 	if err != nil {
 		return nil, err
 	}
-	filePath := fmt.Sprintf("%s/base/images/%s", workDir, file)
-
-	_, err = os.Stat(filePath)
-	exists := !os.IsNotExist(err)
+	switch compression {
+	case "":
+		return f, nil
+	case "gz":
+		gzipReader, err := gzip.NewReader(f)
+		if err != nil {
+			f.Close()
+			return nil, err
+		}
+		return &imageReader{gzipReader, []io.Closer{f, gzipReader}}, nil
+	case "bz2":
+		return &imageReader{bzip2.NewReader(f), []io.Closer{f}}, nil
+	case "xz":
+		cmd := exec.Command("xz", "--decompress", "--stdout")
+		cmd.Stdin = f
+		out, err := cmd.StdoutPipe()
+		if err != nil {
+			f.Close()
+			return nil, err
+		}
+		err = cmd.Start()
+		if err != nil {
+			f.Close()
+			return nil, err
+		}
+		return &imageReader{out, []io.Closer{f, commandCloser{cmd}}}, nil
+	}
+	f.Close()
+	return nil, fmt.Errorf("unsupported compression %s", compression)
+}
 
-	return &IndexEntry{
-		versionInt, checksum, file, exists,
-	}, nil
+type commandCloser struct {
+	cmd *exec.Cmd
+}
 
+func (c commandCloser) Close() error {
+	return c.cmd.Wait()
 }
 
-func getVersion(name string) (int, error) {
-	parts := strings.Split(name, ".")
-	versionWithSuffix := parts[1]
-	parts = strings.Split(versionWithSuffix, "-")
-	if len(parts) != 2 {
-		return -1, fmt.Errorf("invalid version")
+// detectCompression tells the compression of a file by its magic number in
+// the notation of openImage. Uncompressed files result in "".
+func detectCompression(path string) (string, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+	magic := make([]byte, 6)
+	n, err := io.ReadFull(f, magic)
+	if err != nil && err != io.ErrUnexpectedEOF && err != io.EOF {
+		return "", err
 	}
-	version := parts[0]
-	if len(version) != 4 {
-		return -1, fmt.Errorf("invalid version")
+	magic = magic[:n]
+	switch {
+	case bytes.HasPrefix(magic, []byte{0x1f, 0x8b}):
+		return "gz", nil
+	case bytes.HasPrefix(magic, []byte("BZh")):
+		return "bz2", nil
+	case bytes.HasPrefix(magic, []byte{0xfd, '7', 'z', 'X', 'Z', 0}):
+		return "xz", nil
 	}
-	return strconv.Atoi(version)
+	return "", nil
 }
 
+// ProgressWriter reports the combined progress of one or more downloads.
 type ProgressWriter struct {
-	totalSize             int
-	downloadedAmount      int
+	lock                  sync.Mutex
+	totals                map[string]int64
+	done                  map[string]int64
 	lastPrintedPercentage float64
+	lastPrintedAmount     int64
 }
 
-func (p *ProgressWriter) Write(data []byte) (int, error) {
-	amount := len(data)
-	p.downloadedAmount += amount
-	percentage := float64(p.downloadedAmount) / float64(p.totalSize) * 100
+func newProgressWriter() *ProgressWriter {
+	return &ProgressWriter{
+		totals: make(map[string]int64),
+		done:   make(map[string]int64),
+	}
+}
+
+// update records the progress of one download. A total below zero means
+// that the size is not known.
+func (p *ProgressWriter) update(name string, done, total int64) {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+	p.done[name] = done
+	p.totals[name] = total
+
+	var sumDone, sumTotal int64
+	sizeKnown := true
+	for key, total := range p.totals {
+		sumDone += p.done[key]
+		sumTotal += total
+		sizeKnown = sizeKnown && total >= 0
+	}
 
-	if percentage-p.lastPrintedPercentage > 5 || percentage == 100 {
-		fmt.Printf("%.2f%%\n", percentage)
+	if !sizeKnown {
+		if sumDone-p.lastPrintedAmount >= 64*1024*1024 {
+			fmt.Printf("%s\n", formatBytes(uint64(sumDone)))
+			p.lastPrintedAmount = sumDone
+		}
+		return
+	}
+	percentage := float64(sumDone) / float64(sumTotal) * 100
+	if percentage-p.lastPrintedPercentage > 5 || (percentage == 100 && p.lastPrintedPercentage != 100) {
+		fmt.Printf("%.2f%% of %s\n", percentage, formatBytes(uint64(sumTotal)))
 		p.lastPrintedPercentage = percentage
 	}
-	return amount, nil
 }
 
-func newProgressWriter(totalSize int) *ProgressWriter {
-	return &ProgressWriter{
-		totalSize:             totalSize,
-		downloadedAmount:      0,
-		lastPrintedPercentage: 0,
-	}
+// progressCounter is the writer for a single download of a ProgressWriter.
+type progressCounter struct {
+	progress *ProgressWriter
+	name     string
+	done     int64
+	total    int64
+}
+
+func (c *progressCounter) Write(data []byte) (int, error) {
+	c.done += int64(len(data))
+	c.progress.update(c.name, c.done, c.total)
+	return len(data), nil
 }
 
 func round(x, unit float64) float64 {
@@ -0,0 +1,270 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"log"
+	"os/exec"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+
+	libvirt "github.com/libvirt/libvirt-go"
+	"github.com/urfave/cli"
+)
+
+const CONSOLE_TAIL_LINES = 20
+
+// CLOUD_INIT_BOOT_FINISHED is written by cloud-init at the end of its last
+// stage.
+const CLOUD_INIT_BOOT_FINISHED = "/var/lib/cloud/instance/boot-finished"
+
+var waitFlags = []cli.Flag{
+	cli.StringFlag{
+		Name:  "user, u",
+		Usage: "Login user. Defaults to the default user of the node's base image.",
+	},
+	cli.DurationFlag{
+		Name:  "timeout, t",
+		Usage: "Time to wait for the node to become ready",
+		Value: 10 * time.Minute,
+	},
+}
+
+var errNoCloudInit = errors.New("cloud-init is not installed")
+var errNoStatusCommand = errors.New("cloud-init has no status command")
+
+func waitCommand(c *cli.Context) error {
+	nodeNumbers, err := selectedNodes(c)
+	if err != nil {
+		return err
+	}
+
+	conn, err := connect(c)
+	if err != nil {
+		log.Fatal(err)
+	}
+	defer conn.Close()
+
+	workDir := getProjectDir(c)
+	user := c.String("user")
+	timeout := c.Duration("timeout")
+	return forNodesInParallel(conn, nodeNumbers, "ready", func(dom *libvirt.Domain, name string) error {
+		return waitForNode(conn, dom, workDir, user, timeout)
+	})
+}
+
+// waitForNode blocks until dom is ready for use, that is it has an address,
+// ssh answers and cloud-init has finished. Images without cloud-init are
+// ready as soon as the guest agent responds, Ignition images as soon as ssh
+// answers, since Ignition finishes before the system boots. Errors carry the last lines
+// the node printed on its serial console, taken from its console log or,
+// for nodes without one, from the console itself while waiting.
+func waitForNode(conn *libvirt.Connect, dom *libvirt.Domain, workDir, user string, timeout time.Duration) error {
+	logFile, err := consoleLogFile(dom)
+	if err != nil {
+		return err
+	}
+	var tail *consoleTail
+	if logFile == "" {
+		tail = openConsoleTail(conn, dom)
+		defer tail.close()
+	}
+
+	err = waitUntilReady(dom, workDir, user, timeout)
+	if err != nil {
+		var output string
+		if tail != nil {
+			output = tail.String()
+		} else {
+			output, _ = readLogTail(logFile, CONSOLE_TAIL_LINES)
+		}
+		if output != "" {
+			return fmt.Errorf("%s\nlast console output:\n%s", err, output)
+		}
+	}
+	return err
+}
+
+func waitUntilReady(dom *libvirt.Domain, workDir, user string, timeout time.Duration) error {
+	deadline := time.Now().Add(timeout)
+	target, err := sshTarget(dom, workDir, user, timeout)
+	if err != nil {
+		return err
+	}
+	meta, err := getNodeMetadata(dom)
+	if err != nil {
+		return err
+	}
+
+	for {
+		status, err := cloudInitStatus(target)
+		switch {
+		case err == errNoCloudInit && meta.Ignition:
+			return nil
+		case err == errNoCloudInit:
+			_, pingErr := dom.QemuAgentCommand(`{"execute":"guest-ping"}`, libvirt.DOMAIN_QEMU_AGENT_COMMAND_DEFAULT, 0)
+			if pingErr == nil {
+				return nil
+			}
+			err = fmt.Errorf("%s and the guest agent does not respond: %s", err, pingErr)
+		case err == nil && (status == "done" || status == "disabled"):
+			return nil
+		case err == nil && status == "error":
+			return fmt.Errorf("cloud-init failed on %s", target)
+		}
+
+		if time.Now().After(deadline) {
+			if err != nil {
+				return fmt.Errorf("timed out waiting for cloud-init: %s", err)
+			}
+			return fmt.Errorf("timed out waiting for cloud-init, status is %s", status)
+		}
+		time.Sleep(5 * time.Second)
+	}
+}
+
+// cloudInitStatus asks cloud-init on target whether it is still running.
+// Versions of cloud-init without a status command are asked for the file
+// they write when they are done instead.
+func cloudInitStatus(target string) (string, error) {
+	exitCode, out, stderr, err := runOverSSH(target, "cloud-init", "status")
+	if err != nil {
+		return "", err
+	}
+	status, err := parseCloudInitStatus(exitCode, out, stderr)
+	if err != errNoStatusCommand {
+		return status, err
+	}
+
+	exitCode, _, stderr, err = runOverSSH(target, "test", "-f", CLOUD_INIT_BOOT_FINISHED)
+	if err != nil {
+		return "", err
+	}
+	return parseBootFinished(exitCode, stderr)
+}
+
+// parseCloudInitStatus interprets the result of cloud-init status. Exit
+// codes other than 0 for success and 1 or 2 for errors, or output without
+// a status line, come from a cloud-init that does not know the command.
+func parseCloudInitStatus(exitCode int, out, stderr string) (string, error) {
+	switch exitCode {
+	case 0, 1, 2:
+	case 127:
+		return "", errNoCloudInit
+	case 255:
+		return "", fmt.Errorf("ssh failed: %s", strings.TrimSpace(stderr))
+	default:
+		return "", errNoStatusCommand
+	}
+	for _, line := range strings.Split(out, "\n") {
+		if strings.HasPrefix(line, "status:") {
+			return strings.TrimSpace(strings.TrimPrefix(line, "status:")), nil
+		}
+	}
+	return "", errNoStatusCommand
+}
+
+// parseBootFinished turns the result of testing for the boot-finished file
+// into a status as reported by cloud-init status.
+func parseBootFinished(exitCode int, stderr string) (string, error) {
+	switch exitCode {
+	case 0:
+		return "done", nil
+	case 1:
+		return "running", nil
+	case 255:
+		return "", fmt.Errorf("ssh failed: %s", strings.TrimSpace(stderr))
+	}
+	return "", fmt.Errorf("could not check for %s: %s", CLOUD_INIT_BOOT_FINISHED, strings.TrimSpace(stderr))
+}
+
+// runOverSSH runs command on target and returns its exit code and output.
+// Only a failure to start ssh is returned as error.
+func runOverSSH(target string, command ...string) (int, string, string, error) {
+	args := append([]string{"-o", "BatchMode=yes", "-o", "ConnectTimeout=10"}, sshArgs(target)...)
+	cmd := exec.Command("ssh", append(args, command...)...)
+	var stderr bytes.Buffer
+	cmd.Stderr = &stderr
+	out, err := cmd.Output()
+	if exitErr, ok := err.(*exec.ExitError); ok {
+		return exitErr.Sys().(syscall.WaitStatus).ExitStatus(), string(out), stderr.String(), nil
+	} else if err != nil {
+		return 0, "", "", err
+	}
+	return 0, string(out), stderr.String(), nil
+}
+
+// consoleTail records what a node prints on its serial console while it is
+// open. Nodes without a console result in an empty tail.
+type consoleTail struct {
+	lock   sync.Mutex
+	buf    []byte
+	stream *libvirt.Stream
+}
+
+func openConsoleTail(conn *libvirt.Connect, dom *libvirt.Domain) *consoleTail {
+	tail := &consoleTail{}
+	stream, err := conn.NewStream(0)
+	if err != nil {
+		return tail
+	}
+	err = dom.OpenConsole("", stream, libvirt.DOMAIN_CONSOLE_SAFE)
+	if err != nil {
+		stream.Free()
+		return tail
+	}
+	tail.stream = stream
+	go tail.read()
+	return tail
+}
+
+func (t *consoleTail) read() {
+	stream := t.stream
+	defer func() {
+		t.lock.Lock()
+		t.stream = nil
+		t.lock.Unlock()
+		stream.Free()
+	}()
+	buf := make([]byte, 4096)
+	for {
+		n, err := stream.Recv(buf)
+		if n > 0 {
+			t.lock.Lock()
+			t.buf = append(t.buf, bytes.Replace(buf[:n], []byte("\r"), nil, -1)...)
+			if len(t.buf) > 64*1024 {
+				t.buf = t.buf[len(t.buf)-64*1024:]
+			}
+			t.lock.Unlock()
+		}
+		if err != nil || n == 0 {
+			return
+		}
+	}
+}
+
+func (t *consoleTail) String() string {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+	return lastLines(string(t.buf), CONSOLE_TAIL_LINES)
+}
+
+func (t *consoleTail) close() {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+	if t.stream != nil {
+		t.stream.Abort()
+	}
+}
+
+// lastLines returns at most n trailing lines of text.
+func lastLines(text string, n int) string {
+	lines := strings.Split(strings.TrimRight(text, "\n"), "\n")
+	if len(lines) > n {
+		lines = lines[len(lines)-n:]
+	}
+	return strings.Join(lines, "\n")
+}
@@ -0,0 +1,53 @@
+package main
+
+import "testing"
+
+func TestParseCloudInitStatus(t *testing.T) {
+	cases := []struct {
+		exitCode int
+		out      string
+		stderr   string
+		status   string
+		err      error
+	}{
+		{0, "\nstatus: done\n", "", "done", nil},
+		{0, "status: running\n", "", "running", nil},
+		{1, "status: error\n", "", "error", nil},
+		{2, "status: degraded done\n", "", "degraded done", nil},
+		{0, "", "", "", errNoStatusCommand},
+		// cloud-init before 18.2 rejects the unknown subcommand
+		{2, "", "cloud-init: error: argument subcommand: invalid choice: 'status'\n", "", errNoStatusCommand},
+		{3, "status: done\n", "", "", errNoStatusCommand},
+		{127, "", "bash: cloud-init: command not found\n", "", errNoCloudInit},
+	}
+	for _, c := range cases {
+		status, err := parseCloudInitStatus(c.exitCode, c.out, c.stderr)
+		if status != c.status || err != c.err {
+			t.Errorf("exit code %d with %q: got %q, %v, expected %q, %v", c.exitCode, c.out, status, err, c.status, c.err)
+		}
+	}
+
+	_, err := parseCloudInitStatus(255, "", "ssh: connect to host 192.168.122.10 port 22: Connection refused\n")
+	if err == nil || err == errNoStatusCommand {
+		t.Errorf("a failed ssh connection resulted in %v", err)
+	}
+}
+
+func TestParseBootFinished(t *testing.T) {
+	cases := []struct {
+		exitCode int
+		status   string
+		fails    bool
+	}{
+		{0, "done", false},
+		{1, "running", false},
+		{2, "", true},
+		{255, "", true},
+	}
+	for _, c := range cases {
+		status, err := parseBootFinished(c.exitCode, "")
+		if status != c.status || (err != nil) != c.fails {
+			t.Errorf("exit code %d: got %q, %v", c.exitCode, status, err)
+		}
+	}
+}